@@ -0,0 +1,87 @@
+package sexp
+
+import (
+	"bufio"
+	"bytes"
+	"hash"
+	"io"
+	"strconv"
+)
+
+// RivestCanonical returns the canonical representation of n from section 6.1 of
+// the spec, as used for digital signatures: every octet-string, whatever its kind
+// here, is written in verbatim form `<length>:<octets>` and list elements are not
+// separated. since verbatim octets are raw, the result may contain newlines and
+// non-ASCII bytes and is not itself parseable by this package.
+func (n *Node) RivestCanonical() (b []byte, err error) {
+	var buf bytes.Buffer
+
+	err = n.appendCanonical(&buf, make(map[*Node]struct{}))
+	if err != nil {
+		return
+	}
+
+	b = buf.Bytes()
+	return
+}
+
+// HashStream writes the RivestCanonical form of n into h as it is produced, so
+// that large trees can be hashed for signing without holding the whole encoding
+// in memory.
+func (n *Node) HashStream(h hash.Hash) (err error) {
+	w := bufio.NewWriter(h)
+
+	err = n.appendCanonical(w, make(map[*Node]struct{}))
+	if err != nil {
+		return
+	}
+
+	return w.Flush()
+}
+
+// canonicalWriter is satisfied by both bytes.Buffer and bufio.Writer.
+type canonicalWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+func (n *Node) appendCanonical(buf canonicalWriter, parents map[*Node]struct{}) (err error) {
+	if n == nil {
+		return
+	}
+
+	if n.Kind == KindRaw {
+		// the fragment has to be parsed to find its octet-strings:
+		var c *Node
+		c, err = parseOne(n.OctetString)
+		if err != nil {
+			return
+		}
+		return c.appendCanonical(buf, parents)
+	}
+
+	if n.Kind != KindList {
+		buf.WriteString(strconv.Itoa(len(n.OctetString)))
+		buf.WriteByte(':')
+		buf.Write(n.OctetString)
+		return
+	}
+
+	if _, ok := parents[n]; ok {
+		err = ErrCycleDetected
+		return
+	}
+	parents[n] = struct{}{}
+	defer delete(parents, n)
+
+	buf.WriteByte('(')
+	for _, c := range n.List {
+		err = c.appendCanonical(buf, parents)
+		if err != nil {
+			return
+		}
+	}
+	buf.WriteByte(')')
+	return
+}
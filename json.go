@@ -0,0 +1,40 @@
+package sexp
+
+import (
+	"encoding/json"
+)
+
+// MarshalJSON encodes n as a JSON string holding its serialized form, which keeps
+// the kind of every atom and so round-trips through UnmarshalJSON.
+func (n *Node) MarshalJSON() (b []byte, err error) {
+	var str string
+	str, err = n.serialize()
+	if err != nil {
+		return
+	}
+
+	return json.Marshal(str)
+}
+
+// UnmarshalJSON parses a JSON string produced by MarshalJSON into n. a JSON null
+// leaves n unchanged.
+func (n *Node) UnmarshalJSON(b []byte) (err error) {
+	if string(b) == "null" {
+		return
+	}
+
+	var str string
+	err = json.Unmarshal(b, &str)
+	if err != nil {
+		return
+	}
+
+	var v *Node
+	v, err = parseOne([]byte(str))
+	if err != nil {
+		return
+	}
+
+	*n = *v
+	return
+}
@@ -0,0 +1,95 @@
+package sexp
+
+// OrderedMap holds the pairs of an assoc list keyed by token, keeping their order.
+// the zero value is an empty map ready to use.
+type OrderedMap struct {
+	pairs []OrderedPair
+	index map[string]int
+}
+
+type OrderedPair struct {
+	Key   string
+	Value *Node
+}
+
+func NewOrderedMap() *OrderedMap {
+	return &OrderedMap{
+		pairs: nil,
+		index: make(map[string]int),
+	}
+}
+
+func (m *OrderedMap) Get(key string) (value *Node, ok bool) {
+	var i int
+	i, ok = m.index[key]
+	if !ok {
+		return
+	}
+	value = m.pairs[i].Value
+	return
+}
+
+// Set replaces the value of an existing key in place or appends a new pair.
+func (m *OrderedMap) Set(key string, value *Node) {
+	if i, ok := m.index[key]; ok {
+		m.pairs[i].Value = value
+		return
+	}
+
+	if m.index == nil {
+		m.index = make(map[string]int)
+	}
+	m.index[key] = len(m.pairs)
+	m.pairs = append(m.pairs, OrderedPair{Key: key, Value: value})
+}
+
+func (m *OrderedMap) Keys() []string {
+	keys := make([]string, len(m.pairs))
+	for i, p := range m.pairs {
+		keys[i] = p.Key
+	}
+	return keys
+}
+
+func (m *OrderedMap) Pairs() []OrderedPair {
+	return append([]OrderedPair(nil), m.pairs...)
+}
+
+func (m *OrderedMap) Len() int {
+	return len(m.pairs)
+}
+
+// ToOrderedMap reads an assoc list into an OrderedMap, failing on duplicate keys.
+func (n *Node) ToOrderedMap() (m *OrderedMap, err error) {
+	m = NewOrderedMap()
+	err = n.ForEachPair(func(key string, value *Node) error {
+		if _, ok := m.index[key]; ok {
+			return ErrDuplicateKey
+		}
+		m.Set(key, value)
+		return nil
+	})
+	if err != nil {
+		m = nil
+	}
+	return
+}
+
+// FromOrderedMap builds an assoc list from m in key order.
+func FromOrderedMap(m *OrderedMap) (n *Node, err error) {
+	children := make([]*Node, 0, len(m.pairs))
+	for _, p := range m.pairs {
+		var key, pair *Node
+		key, err = LimitedProducer.Token(p.Key)
+		if err != nil {
+			return
+		}
+		pair, err = LimitedProducer.List(key, p.Value)
+		if err != nil {
+			return
+		}
+		children = append(children, pair)
+	}
+
+	return LimitedProducer.List(children...)
+}
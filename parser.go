@@ -1,11 +1,14 @@
 package sexp
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
-	"strconv"
+	"math"
 	"strings"
 	"unicode"
 )
@@ -18,6 +21,8 @@ type Parser interface {
 	ParseBase64(s io.RuneScanner, h LengthHint) (n *Node, err error)
 }
 
+// LengthHint is the optional decimal prefix of an octet-string. Length counts
+// decoded octets, not the hex digits or base-64 characters that encode them.
 type LengthHint struct {
 	Has    bool
 	Length uint64
@@ -25,24 +30,505 @@ type LengthHint struct {
 
 type parser struct {
 	disallowNewlines bool
+	preserveHints    bool
+	maxTotalOctets   int
+	hexSeparators    string
+	rejectEmptyLists bool
+	detectDupKeys    bool
+
+	// totalOctets accumulates decoded octet-string sizes across one ParseNode call
+	totalOctets *int
+	// keyOffsets maps each list parsed in one ParseNode call to the input offset
+	// of its first element, so duplicate keys can be reported by position
+	keyOffsets map[*Node]int64
 }
 
+// parsers hold only configuration and are passed by value; any state needed while
+// parsing lives in the copy made by each ParseNode call, so a parser, including
+// LimitedParser and FullParser, is safe for concurrent use. options added later
+// must keep to this.
 var LimitedParser = parser{disallowNewlines: true}
 var FullParser = parser{disallowNewlines: false}
 
 var _ = FullParser
 
+// WithPreserveHints returns a copy of the parser that records any length prefix
+// on the parsed octet-string nodes so that String() reproduces it.
+func (e parser) WithPreserveHints(preserve bool) parser {
+	e.preserveHints = preserve
+	return e
+}
+
+// WithMaxTotalOctets returns a copy of the parser that fails with ErrInputTooLarge
+// once the octet-strings decoded by a single ParseNode call would exceed max
+// bytes in total. a max of 0 means no limit.
+func (e parser) WithMaxTotalOctets(max int) parser {
+	e.maxTotalOctets = max
+	return e
+}
+
+// WithHexSeparators returns a copy of the parser that skips any of the runes in
+// seps between the digits of a hexadecimal octet-string, e.g. ":" to accept
+// `#ab:cd:ef#`. separators that are hexadecimal digits or `#` have no effect.
+func (e parser) WithHexSeparators(seps string) parser {
+	e.hexSeparators = seps
+	return e
+}
+
+// WithRejectEmptyLists returns a copy of the parser that fails with ErrEmptyList
+// on any `()`, at any depth.
+func (e parser) WithRejectEmptyLists(reject bool) parser {
+	e.rejectEmptyLists = reject
+	return e
+}
+
+// WithDetectDuplicateKeys returns a copy of the parser that fails with
+// ErrDuplicateKey when an assoc list (see ForEachPair), at any depth, repeats a
+// key. the error names the key and the input offset at which it repeats, or the
+// index of the pair when the offset is not known (ParseList called directly).
+func (e parser) WithDetectDuplicateKeys(detect bool) parser {
+	e.detectDupKeys = detect
+	return e
+}
+
+// reserveOctets accounts for an octet-string of size bytes before it is allocated
+func (e parser) reserveOctets(size uint64) (err error) {
+	if e.maxTotalOctets <= 0 {
+		return
+	}
+
+	total := uint64(0)
+	if e.totalOctets != nil {
+		total = uint64(*e.totalOctets)
+	}
+	if size > uint64(e.maxTotalOctets)-total {
+		err = ErrInputTooLarge
+		return
+	}
+
+	if e.totalOctets != nil {
+		*e.totalOctets += int(size)
+	}
+	return
+}
+
+// bodyLimit is the most encoded characters readOctetBody may buffer for an
+// octet-string, given the per-chunk expansion of its encoding; the tighter of
+// the remaining budget and the length prefix applies. prefixBound is true when
+// the length prefix is the tighter one.
+func (e parser) bodyLimit(h LengthHint, octets, chars uint64) (max int, prefixBound bool) {
+	max = math.MaxInt
+	if h.Has {
+		max = encodedLimit(h.Length, octets, chars)
+		prefixBound = true
+	}
+	if e.maxTotalOctets > 0 {
+		remaining := uint64(e.maxTotalOctets)
+		if e.totalOctets != nil {
+			remaining -= uint64(*e.totalOctets)
+		}
+		if m := encodedLimit(remaining, octets, chars); m < max {
+			max, prefixBound = m, false
+		}
+	}
+	return
+}
+
+// encodedLimit is the number of characters that encode n octets when each chunk
+// of up to octets bytes takes chars characters, saturating at math.MaxInt.
+func encodedLimit(n, octets, chars uint64) int {
+	chunks := n / octets
+	if n%octets != 0 {
+		chunks++
+	}
+	if chunks > math.MaxInt/chars {
+		return math.MaxInt
+	}
+	return int(chunks * chars)
+}
+
+// Parse parses the next node from s using LimitedParser. it returns io.EOF when
+// s holds no more nodes, i.e. it is empty or contains only whitespace.
+// errors from within an atom or length prefix name it in their message and wrap
+// the sentinel, so compare them with errors.Is.
 func Parse(s io.RuneScanner) (n *Node, err error) {
 	return LimitedParser.ParseNode(s)
 }
+
+// Scan parses consecutive top-level nodes from r and calls fn for each one
+// until r is exhausted. it stops at the first error returned by either the
+// parser or fn.
+func Scan(r io.Reader, fn func(n *Node) error) (err error) {
+	s, ok := r.(io.RuneScanner)
+	if !ok {
+		s = bufio.NewReader(r)
+	} else if _, ok = s.(io.ByteScanner); !ok {
+		// keep the lookahead across nodes:
+		s = Lookahead(s)
+	}
+
+	var n *Node
+	for {
+		n, err = Parse(s)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		err = fn(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ParseNULDelimited reads r to the end and parses each NUL-terminated segment as
+// exactly one expression; the last segment need not be terminated. the
+// serialized form never contains NUL, since arbitrary octets are always hex or
+// base-64 encoded, so this framing is safe for any node. segments that are
+// empty or only whitespace are skipped. on error the nodes parsed so far are
+// returned with it.
+func ParseNULDelimited(r io.Reader) (nodes []*Node, err error) {
+	br := bufio.NewReader(r)
+	for {
+		var seg []byte
+		seg, err = br.ReadBytes(0)
+		if err != nil && err != io.EOF {
+			return
+		}
+		last := err == io.EOF
+
+		if len(seg) > 0 && seg[len(seg)-1] == 0 {
+			seg = seg[:len(seg)-1]
+		}
+		if len(seg) > 0 {
+			var n *Node
+			n, err = parseOne(seg)
+			if err != nil && err != io.EOF {
+				return
+			}
+			if n != nil {
+				nodes = append(nodes, n)
+			}
+		}
+
+		if last {
+			err = nil
+			return
+		}
+	}
+}
+
+// ParseAllN parses up to max consecutive top-level nodes from s. it returns a
+// nil error when s is exhausted first, and ErrLimitReached along with the max
+// nodes read when it stops early, in which case more may remain in s. on any
+// other error the nodes parsed so far are returned with it. a max below 1 fails
+// with ErrInvalidLimit before anything is read, rather than being mistaken for a
+// limit reached.
+func ParseAllN(s io.RuneScanner, max int) (nodes []*Node, err error) {
+	if max < 1 {
+		err = ErrInvalidLimit
+		return
+	}
+	if _, ok := s.(io.ByteScanner); !ok {
+		// keep the lookahead across nodes:
+		s = Lookahead(s)
+	}
+
+	var n *Node
+	for len(nodes) < max {
+		n, err = Parse(s)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	err = ErrLimitReached
+	return
+}
+
+// ParseBase64Wrapped base-64 decodes s and parses the result as exactly one
+// expression; it is the inverse of MarshalBase64Wrapped.
+func ParseBase64Wrapped(s string) (n *Node, err error) {
+	var b []byte
+	b, err = base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return
+	}
+
+	return parseOne(b)
+}
+
+// ParseCanonical parses b as exactly one expression and requires b to be
+// byte-for-byte what String would produce for the result: single spaces between
+// list elements and no other whitespace, no length prefixes and lowercase hex.
+// other valid input fails with ErrNotCanonical. this is the
+// package's own form, not the verbatim form of RivestCanonical.
+func ParseCanonical(b []byte) (n *Node, err error) {
+	n, err = parseOne(b)
+	if err != nil {
+		return
+	}
+
+	var str string
+	str, err = n.serialize()
+	if err != nil {
+		n = nil
+		return
+	}
+	if str != string(b) {
+		n, err = nil, ErrNotCanonical
+		return
+	}
+	return
+}
+
+// parseOne parses b as exactly one expression.
+func parseOne(b []byte) (n *Node, err error) {
+	r := bytes.NewReader(b)
+	n, err = Parse(r)
+	if err != nil {
+		return
+	}
+
+	// only trailing whitespace may follow the expression:
+	_, err = Parse(r)
+	if err != io.EOF {
+		n, err = nil, ErrUnexpectedChar
+		return
+	}
+
+	err = nil
+	return
+}
+
+// ValidatePrefix reports whether b is the start of a single valid expression
+// (ok) and whether that expression is already complete. once ok is false no
+// further input can make b valid, which lets readers reject malformed input
+// without waiting for the rest of it. note that a lone token is complete even
+// though more input could still extend it.
+func ValidatePrefix(b []byte) (ok bool, complete bool) {
+	s := &eofScanner{RuneScanner: bytes.NewReader(b)}
+
+	_, err := Parse(s)
+	if err == io.EOF {
+		// only whitespace so far:
+		return true, false
+	}
+	if err != nil {
+		// errors caused by running out of input may still be fixed by more input:
+		fixable := errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrUnbalancedParen)
+		return s.eof && fixable, false
+	}
+
+	// only whitespace may follow the expression:
+	_, err = Parse(s)
+	if err != io.EOF {
+		return false, false
+	}
+	return true, true
+}
+
+// lookaheadScanner implements UnreadRune for a single rune itself rather than
+// relying on the wrapped scanner to support it.
+type lookaheadScanner struct {
+	s io.RuneScanner
+
+	last     rune
+	lastSize int
+	has      bool
+	unread   bool
+}
+
+func (l *lookaheadScanner) ReadRune() (r rune, size int, err error) {
+	if l.unread {
+		l.unread = false
+		return l.last, l.lastSize, nil
+	}
+
+	r, size, err = l.s.ReadRune()
+	l.has = err == nil
+	l.last, l.lastSize = r, size
+	return
+}
+
+func (l *lookaheadScanner) UnreadRune() error {
+	if !l.has || l.unread {
+		return bufio.ErrInvalidUnreadRune
+	}
+	l.unread = true
+	return nil
+}
+
+// Lookahead wraps a scanner that cannot unread in one that can. pass the result
+// to every ParseNode call on the stream so that the rune ending one node, e.g.
+// the `(` in `a(b)`, is kept for the next call. Scan and ParseAllN do this
+// themselves.
+func Lookahead(s io.RuneScanner) io.RuneScanner {
+	if la, ok := s.(*lookaheadScanner); ok {
+		return la
+	}
+	return &lookaheadScanner{s: s}
+}
+
+// release hands a still-buffered rune back to the wrapped scanner. if that
+// scanner cannot unread, the rune is lost, which only matters when it is not
+// whitespace; then ErrLookaheadLost is returned along with the completed node.
+func (l *lookaheadScanner) release(e parser) (err error) {
+	if !l.unread {
+		return
+	}
+	l.unread = false
+
+	if l.s.UnreadRune() == nil {
+		return
+	}
+	if discard, derr := e.shouldDiscard(l.last); derr == nil && discard {
+		return
+	}
+	return ErrLookaheadLost
+}
+
+// offsetScanner counts the bytes read from the wrapped scanner so that errors can
+// report where in the input they occurred.
+type offsetScanner struct {
+	s        io.RuneScanner
+	offset   int64
+	lastSize int
+}
+
+func (o *offsetScanner) ReadRune() (r rune, size int, err error) {
+	r, size, err = o.s.ReadRune()
+	o.offset += int64(size)
+	o.lastSize = size
+	return
+}
+
+func (o *offsetScanner) UnreadRune() (err error) {
+	err = o.s.UnreadRune()
+	if err == nil {
+		o.offset -= int64(o.lastSize)
+		o.lastSize = 0
+	}
+	return
+}
+
+func (o *offsetScanner) inputOffset() int64 {
+	return o.offset
+}
+
+// offsetByteScanner is an offsetScanner that keeps the byte-oriented fast paths
+// available when the wrapped scanner supports them.
+type offsetByteScanner struct {
+	offsetScanner
+	bs io.ByteScanner
+}
+
+func (o *offsetByteScanner) ReadByte() (c byte, err error) {
+	c, err = o.bs.ReadByte()
+	if err == nil {
+		o.offset++
+		o.lastSize = 1
+	}
+	return
+}
+
+func (o *offsetByteScanner) UnreadByte() (err error) {
+	err = o.bs.UnreadByte()
+	if err == nil {
+		o.offset--
+		o.lastSize = 0
+	}
+	return
+}
+
+func newOffsetScanner(s io.RuneScanner) io.RuneScanner {
+	if bs, ok := s.(io.ByteScanner); ok {
+		return &offsetByteScanner{offsetScanner: offsetScanner{s: s}, bs: bs}
+	}
+	return &offsetScanner{s: s}
+}
+
+// unbalancedParen reports ErrUnbalancedParen for the paren at offset, or without
+// a position when s does not count offsets, i.e. when ParseList is called directly.
+func unbalancedParen(s io.RuneScanner, offset int64) error {
+	if _, ok := s.(interface{ inputOffset() int64 }); !ok {
+		return ErrUnbalancedParen
+	}
+	return &UnbalancedParenError{Offset: offset}
+}
+
+// inputOffset returns the number of bytes read from s so far in this ParseNode
+// call, or -1 if s does not count them.
+func inputOffset(s io.RuneScanner) int64 {
+	if o, ok := s.(interface{ inputOffset() int64 }); ok {
+		return o.inputOffset()
+	}
+	return -1
+}
+
+// eofScanner records whether the wrapped scanner has reached the end of its input
+type eofScanner struct {
+	io.RuneScanner
+	eof bool
+}
+
+func (s *eofScanner) ReadRune() (r rune, size int, err error) {
+	r, size, err = s.RuneScanner.ReadRune()
+	if err == io.EOF {
+		s.eof = true
+	}
+	return
+}
+
 func (e parser) ParseNode(s io.RuneScanner) (n *Node, err error) {
+	if e.maxTotalOctets > 0 {
+		e.totalOctets = new(int)
+	}
+	if e.detectDupKeys {
+		e.keyOffsets = make(map[*Node]int64)
+	}
+
+	// the standard byte-oriented readers all support UnreadRune; anything else
+	// gets a one-rune lookahead buffer so the parser never depends on it. a
+	// buffer from Lookahead is kept by the caller between calls. if the rune that
+	// ended the node cannot be handed back, the node is still returned so the
+	// caller does not lose it:
+	_, isByteScanner := s.(io.ByteScanner)
+	_, isLookahead := s.(*lookaheadScanner)
+	if !isByteScanner && !isLookahead {
+		la := &lookaheadScanner{s: s}
+		defer func() {
+			lerr := la.release(e)
+			if lerr != nil && err == nil {
+				err = lerr
+			}
+		}()
+		s = la
+	}
+	s = newOffsetScanner(s)
+
 	var listEnd bool
 	n, listEnd, err = e.parseNode(s)
 	if listEnd {
-		err = ErrUnexpectedChar
+		// a closing paren without a list to close; leave it unread:
+		err = s.UnreadRune()
+		if err == nil {
+			err = unbalancedParen(s, inputOffset(s))
+		}
 	}
-	if err == io.EOF {
-		// allow regular EOF errors but still fail on ErrUnexpectedEOF
+	if err == io.EOF && n != nil {
+		// allow regular EOF errors after a complete node but still fail on
+		// ErrUnexpectedEOF. io.EOF is returned as-is when the input held no node.
 		err = nil
 	}
 	if err != nil {
@@ -67,7 +553,7 @@ func (e parser) shouldDiscard(r rune) (discard bool, err error) {
 	}
 
 	// ignore acceptable whitespace chars:
-	if r <= ' ' || r == '\t' || r == '\v' || r == '\f' {
+	if r == ' ' || r == '\t' || r == '\v' || r == '\f' {
 		discard = true
 		return
 	}
@@ -93,63 +579,83 @@ func (e parser) parseNode(s io.RuneScanner) (n *Node, listEnd bool, err error) {
 			continue
 		}
 
-		if r == ')' {
-			return nil, true, nil
-		}
-		if r == '(' {
-			n, err = e.ParseList(s)
+		return e.parseNodeAt(s, r)
+	}
+}
+
+// parseNodeAt parses the node starting with r, the first non-whitespace rune
+// already read from s.
+func (e parser) parseNodeAt(s io.RuneScanner, r rune) (n *Node, listEnd bool, err error) {
+	if r == ')' {
+		return nil, true, nil
+	}
+	if r == '(' {
+		n, err = e.ParseList(s)
+		return
+	}
+
+	// tokens may not start with leading decimal:
+	if isTokenStart(r) {
+		err = s.UnreadRune()
+		if err != nil {
 			return
 		}
+		n, err = e.ParseToken(s)
+		return
+	}
 
-		// tokens may not start with leading decimal:
-		if isTokenStart(r) {
-			err = s.UnreadRune()
-			if err != nil {
-				return
-			}
-			n, err = e.ParseToken(s)
+	// parse optional leading decimal indicating size:
+	var h LengthHint
+	if r >= '0' && r <= '9' {
+		err = s.UnreadRune()
+		if err != nil {
 			return
 		}
 
-		// parse optional leading decimal indicating size:
-		var h LengthHint
-		if r >= '0' && r <= '9' {
-			err = s.UnreadRune()
-			if err != nil {
-				return
-			}
-
-			h.Length, err = e.ParseDecimal(s)
-			if err != nil {
-				return
-			}
-			h.Has = true
-
-			r, _, err = s.ReadRune()
-			if err != nil {
-				return
-			}
+		h.Length, err = e.ParseDecimal(s)
+		if err == io.EOF {
+			// a length prefix must be followed by an octet-string:
+			err = io.ErrUnexpectedEOF
 		}
-
-		if r == '|' {
-			n, err = e.ParseBase64(s, h)
+		if err != nil {
 			return
 		}
-		if r == '#' {
-			n, err = e.ParseHexadecimal(s, h)
+		h.Has = true
+
+		r, _, err = s.ReadRune()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
 			return
 		}
+	}
+
+	if r == '|' {
+		n, err = e.ParseBase64(s, h)
+		return
+	}
+	if r == '#' {
+		n, err = e.ParseHexadecimal(s, h)
+		return
+	}
 
-		err = ErrUnexpectedChar
+	// leave the offending char unread so the stream is positioned at it:
+	err = s.UnreadRune()
+	if err != nil {
 		return
 	}
+	err = ErrUnexpectedChar
+	return
 }
 
 func (e parser) ParseList(s io.RuneScanner) (n *Node, err error) {
+	// the opening paren has just been read:
+	start := inputOffset(s) - 1
 	defer func() {
-		// convert regular EOF errors to ErrUnexpectedEOF
+		// running out of input before the closing paren:
 		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+			err = unbalancedParen(s, start)
 		}
 	}()
 
@@ -160,8 +666,9 @@ func (e parser) ParseList(s io.RuneScanner) (n *Node, err error) {
 	}
 
 	var r rune
+	var size int
 	for {
-		r, _, err = s.ReadRune()
+		r, size, err = s.ReadRune()
 		if err != nil {
 			return
 		}
@@ -175,14 +682,15 @@ func (e parser) ParseList(s io.RuneScanner) (n *Node, err error) {
 			continue
 		}
 
-		err = s.UnreadRune()
-		if err != nil {
-			return
+		if e.keyOffsets != nil && len(n.List) == 0 && r != ')' {
+			if off := inputOffset(s); off >= 0 {
+				e.keyOffsets[n] = off - int64(size)
+			}
 		}
 
 		var child *Node
 		var listEnd bool
-		child, listEnd, err = e.parseNode(s)
+		child, listEnd, err = e.parseNodeAt(s, r)
 		if err != nil {
 			return nil, err
 		}
@@ -193,6 +701,37 @@ func (e parser) ParseList(s io.RuneScanner) (n *Node, err error) {
 		n.List = append(n.List, child)
 	}
 
+	if e.rejectEmptyLists && len(n.List) == 0 {
+		return nil, ErrEmptyList
+	}
+	if e.detectDupKeys {
+		err = e.checkDuplicateKeys(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// checkDuplicateKeys fails if n is an assoc list with a repeated key. lists of
+// any other shape pass.
+func (e parser) checkDuplicateKeys(n *Node) (err error) {
+	if !n.isAssoc() {
+		return
+	}
+
+	seen := make(map[string]struct{}, len(n.List))
+	for i, c := range n.List {
+		key := string(c.List[0].OctetString)
+		if _, ok := seen[key]; ok {
+			if off, ok := e.keyOffsets[c]; ok {
+				return fmt.Errorf("%w: %q at offset %d", ErrDuplicateKey, key, off)
+			}
+			return fmt.Errorf("%w: %q in pair %d", ErrDuplicateKey, key, i)
+		}
+		seen[key] = struct{}{}
+	}
 	return
 }
 
@@ -232,8 +771,31 @@ func isTokenRemainder(r rune) bool {
 	return isAlpha(r) || isDigit(r) || isGraphic(r)
 }
 
+func isToken(b []byte) bool {
+	for i, c := range b {
+		if i == 0 && !isTokenStart(rune(c)) {
+			return false
+		} else if i > 0 && !isTokenRemainder(rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// wrapParseError names the construct being parsed in err while keeping it
+// matchable with errors.Is. io.EOF is returned as is since callers compare it
+// directly to detect the end of input.
+func wrapParseError(what string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return fmt.Errorf("parsing %s: %w", what, err)
+}
+
 func (e parser) ParseDecimal(s io.RuneScanner) (v uint64, err error) {
-	var sb strings.Builder
+	defer func() { err = wrapParseError("length prefix", err) }()
+
+	digits := 0
 
 	var r rune
 	for {
@@ -248,15 +810,31 @@ func (e parser) ParseDecimal(s io.RuneScanner) (v uint64, err error) {
 				return
 			}
 
-			v, err = strconv.ParseUint(sb.String(), 10, 64)
+			if digits == 0 {
+				err = ErrInvalidLengthPrefix
+			}
 			return
 		}
 
-		sb.WriteRune(r)
+		// accumulate directly rather than allocating a string for strconv:
+		d := uint64(r - '0')
+		if v > (math.MaxUint64-d)/10 {
+			err = ErrInvalidLengthPrefix
+			return
+		}
+		v = v*10 + d
+		digits++
 	}
 }
 
 func (e parser) ParseToken(s io.RuneScanner) (n *Node, err error) {
+	defer func() { err = wrapParseError("token", err) }()
+
+	// tokens are ASCII-only so skip UTF-8 decoding when bytes can be read directly:
+	if bs, ok := s.(io.ByteScanner); ok {
+		return e.parseTokenBytes(bs)
+	}
+
 	var sb bytes.Buffer
 
 	var r rune
@@ -297,26 +875,13 @@ func (e parser) ParseToken(s io.RuneScanner) (n *Node, err error) {
 	return
 }
 
-func isHexadecimalRemainder(r rune) bool {
-	if r >= '0' && r <= '9' {
-		return true
-	}
-	if r >= 'A' && r <= 'F' {
-		return true
-	}
-	if r >= 'a' && r <= 'f' {
-		return true
-	}
-	return false
-}
-
-func (e parser) ParseHexadecimal(s io.RuneScanner, h LengthHint) (n *Node, err error) {
+func (e parser) parseTokenBytes(s io.ByteScanner) (n *Node, err error) {
 	var sb bytes.Buffer
 
-	var r rune
+	var c byte
 	eof := false
 	for !eof {
-		r, _, err = s.ReadRune()
+		c, err = s.ReadByte()
 		if err == io.EOF {
 			eof = true
 			err = nil
@@ -326,6 +891,57 @@ func (e parser) ParseHexadecimal(s io.RuneScanner, h LengthHint) (n *Node, err e
 			return
 		}
 
+		if !isTokenRemainder(rune(c)) {
+			break
+		}
+
+		sb.WriteByte(c)
+	}
+
+	if !eof {
+		err = s.UnreadByte()
+		if err != nil {
+			return
+		}
+	}
+
+	n = &Node{
+		Kind:        KindToken,
+		OctetString: sb.Bytes(),
+		List:        nil,
+	}
+	if eof {
+		err = io.EOF
+	}
+	return
+}
+
+// readOctetBody reads the body of an encoded octet-string into sb up to and
+// including its closing delimiter. whitespace and any of the runes in seps are
+// skipped; any other rune must satisfy isValid. it fails with ErrInputTooLarge
+// as soon as the body would grow past max characters.
+func (e parser) readOctetBody(s io.RuneScanner, sb *bytes.Buffer, delim rune, isValid func(r rune) bool, seps string, max int) (err error) {
+	// the body is ASCII-only so skip UTF-8 decoding when bytes can be read directly:
+	bs, isByteScanner := s.(io.ByteScanner)
+
+	var r rune
+	for {
+		if isByteScanner {
+			var c byte
+			c, err = bs.ReadByte()
+			r = rune(c)
+		} else {
+			r, _, err = s.ReadRune()
+		}
+		if err == io.EOF {
+			// the closing delimiter is missing:
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		if err != nil {
+			return
+		}
+
 		var discard bool
 		discard, err = e.shouldDiscard(r)
 		if err != nil {
@@ -335,50 +951,118 @@ func (e parser) ParseHexadecimal(s io.RuneScanner, h LengthHint) (n *Node, err e
 			continue
 		}
 
-		if r == '#' {
-			break
+		if r == delim {
+			return
 		}
 
-		if !isHexadecimalRemainder(r) {
+		if !isValid(r) {
+			if strings.ContainsRune(seps, r) {
+				continue
+			}
 			err = ErrUnexpectedChar
 			return
 		}
+		if sb.Len() >= max {
+			err = ErrInputTooLarge
+			return
+		}
 
-		sb.WriteRune(r)
+		sb.WriteByte(byte(r))
 	}
+}
 
-	if !eof {
-		err = s.UnreadRune()
-		if err != nil {
+func isHexadecimalRemainder(r rune) bool {
+	if r >= '0' && r <= '9' {
+		return true
+	}
+	if r >= 'A' && r <= 'F' {
+		return true
+	}
+	if r >= 'a' && r <= 'f' {
+		return true
+	}
+	return false
+}
+
+func (e parser) ParseHexadecimal(s io.RuneScanner, h LengthHint) (n *Node, err error) {
+	defer func() { err = wrapParseError("hex-string", err) }()
+
+	// stop reading once the digits encode more octets than the prefix or the
+	// budget allows:
+	max, prefixBound := e.bodyLimit(h, 1, 2)
+
+	var sb bytes.Buffer
+	err = e.readOctetBody(s, &sb, '#', isHexadecimalRemainder, e.hexSeparators, max)
+	if err == ErrInputTooLarge && prefixBound {
+		err = ErrInvalidLengthPrefix
+	}
+	if err != nil {
+		return
+	}
+
+	size := uint64(hex.DecodedLen(sb.Len()))
+	// check the prefix before reserving or allocating anything for the body:
+	if h.Has && h.Length != size {
+		if h.Length == uint64(sb.Len()) {
+			// a common mistake is to count the digits rather than the octets:
+			err = fmt.Errorf("%w: %d counts hex digits, not the %d octets they encode", ErrInvalidLengthPrefix, h.Length, size)
 			return
 		}
-	} else {
-		err = io.ErrUnexpectedEOF
+		err = ErrInvalidLengthPrefix
 		return
 	}
-
-	var dst []byte
-	if h.Has {
-		dst = make([]byte, h.Length)
-	} else {
-		dst = make([]byte, hex.DecodedLen(sb.Len()))
+	err = e.reserveOctets(size)
+	if err != nil {
+		return
 	}
 
+	dst := make([]byte, size)
+
 	var dn int
 	dn, err = hex.Decode(dst, sb.Bytes())
 	if err != nil {
 		return
 	}
-	if h.Has && dn != len(dst) {
-		err = ErrInvalidLengthPrefix
-		return
-	}
 
 	n = &Node{
 		Kind:        KindHexadecimal,
 		OctetString: dst[:dn],
 		List:        nil,
 	}
+	if e.preserveHints {
+		n.Hint = h
+	}
+	return
+}
+
+// DecodeHexString decodes hexadecimal digits using the same rules as the body
+// of a hexadecimal octet-string: spaces and tabs between digits are ignored
+// while newlines and any other characters are rejected.
+func DecodeHexString(s []byte) (b []byte, err error) {
+	digits := make([]byte, 0, len(s))
+	for _, c := range s {
+		var discard bool
+		discard, err = LimitedParser.shouldDiscard(rune(c))
+		if err != nil {
+			return
+		}
+		if discard {
+			continue
+		}
+
+		if !isHexadecimalRemainder(rune(c)) {
+			err = ErrUnexpectedChar
+			return
+		}
+
+		digits = append(digits, c)
+	}
+
+	b = make([]byte, hex.DecodedLen(len(digits)))
+	_, err = hex.Decode(b, digits)
+	if err != nil {
+		b = nil
+	}
 	return
 }
 
@@ -395,77 +1079,72 @@ func isBase64Remainder(r rune) bool {
 	if r == '+' || r == '/' {
 		return true
 	}
+	// padding; the decoder rejects it anywhere but the end:
+	if r == '=' {
+		return true
+	}
 	return false
 }
 
-func (e parser) ParseBase64(s io.RuneScanner, h LengthHint) (n *Node, err error) {
-	var sb bytes.Buffer
-
-	var r rune
-	eof := false
-	for !eof {
-		r, _, err = s.ReadRune()
-		if err == io.EOF {
-			eof = true
-			err = nil
-			break
-		}
-		if err != nil {
-			return
-		}
-
-		var discard bool
-		discard, err = e.shouldDiscard(r)
-		if err != nil {
-			return
-		}
-		if discard {
-			continue
-		}
+// base64DecodedLen is the number of octets that body decodes to, if valid.
+// unlike base64.StdEncoding.DecodedLen it does not count padding as data.
+func base64DecodedLen(body []byte) int {
+	size := base64.StdEncoding.DecodedLen(len(body))
+	for i := len(body) - 1; i >= 0 && body[i] == '=' && size > 0; i-- {
+		size--
+	}
+	return size
+}
 
-		if r == '|' {
-			break
-		}
+func (e parser) ParseBase64(s io.RuneScanner, h LengthHint) (n *Node, err error) {
+	defer func() { err = wrapParseError("base64-string", err) }()
 
-		if !isBase64Remainder(r) {
-			err = ErrUnexpectedChar
-			return
-		}
+	// stop reading once the body encodes more octets than the prefix or the
+	// budget allows:
+	max, prefixBound := e.bodyLimit(h, 3, 4)
 
-		sb.WriteRune(r)
+	var sb bytes.Buffer
+	err = e.readOctetBody(s, &sb, '|', isBase64Remainder, "", max)
+	if err == ErrInputTooLarge && prefixBound {
+		err = ErrInvalidLengthPrefix
 	}
-
-	if !eof {
-		err = s.UnreadRune()
-		if err != nil {
-			return
+	if err == io.ErrUnexpectedEOF && h.Has {
+		// each 4 characters other than padding encode 3 octets:
+		data := len(bytes.TrimRight(sb.Bytes(), "="))
+		if uint64(data*3/4) > h.Length {
+			err = ErrInvalidLengthPrefix
 		}
-	} else {
-		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
 		return
 	}
 
-	var dst []byte
-	if h.Has {
-		dst = make([]byte, h.Length)
-	} else {
-		dst = make([]byte, base64.StdEncoding.DecodedLen(sb.Len()))
+	size := uint64(base64DecodedLen(sb.Bytes()))
+	// check the prefix before reserving or allocating anything for the body:
+	if h.Has && h.Length != size {
+		err = ErrInvalidLengthPrefix
+		return
 	}
+	err = e.reserveOctets(size)
+	if err != nil {
+		return
+	}
+
+	dst := make([]byte, size)
 
 	var dn int
 	dn, err = base64.StdEncoding.Decode(dst, sb.Bytes())
 	if err != nil {
 		return
 	}
-	if h.Has && dn != len(dst) {
-		err = ErrInvalidLengthPrefix
-		return
-	}
 
 	n = &Node{
 		Kind:        KindBase64,
 		OctetString: dst[:dn],
 		List:        nil,
 	}
+	if e.preserveHints {
+		n.Hint = h
+	}
 	return
 }
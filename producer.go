@@ -1,5 +1,7 @@
 package sexp
 
+import "io"
+
 type Producer interface {
 	Token(s string) (n *Node, err error)
 	Hexadecimal(s []byte) (n *Node, err error)
@@ -11,6 +13,7 @@ type producer struct {
 	disallowNewlines bool
 }
 
+// producers hold no mutable state and are safe for concurrent use.
 var LimitedProducer = producer{disallowNewlines: true}
 var FullProducer = producer{disallowNewlines: false}
 
@@ -25,12 +28,8 @@ func MustToken(s string) (n *Node) {
 	return n
 }
 func (e producer) Token(s string) (n *Node, err error) {
-	for i, r := range s {
-		if i == 0 && !isTokenStart(r) {
-			return nil, ErrInvalidTokenChar
-		} else if i > 0 && !isTokenRemainder(r) {
-			return nil, ErrInvalidTokenChar
-		}
+	if s == "" || !isToken([]byte(s)) {
+		return nil, ErrInvalidTokenChar
 	}
 
 	return &Node{
@@ -56,6 +55,27 @@ func (e producer) Hexadecimal(s []byte) (n *Node, err error) {
 	}, nil
 }
 
+func MustHexString(s string) (n *Node) {
+	var err error
+	n, err = LimitedProducer.HexString(s)
+	if err != nil {
+		panic(err)
+	}
+	return
+}
+
+// HexString builds a hexadecimal node from hex digits, following the same rules
+// as DecodeHexString.
+func (e producer) HexString(s string) (n *Node, err error) {
+	var b []byte
+	b, err = DecodeHexString([]byte(s))
+	if err != nil {
+		return
+	}
+
+	return e.Hexadecimal(b)
+}
+
 func MustBase64(s []byte) (n *Node) {
 	var err error
 	n, err = LimitedProducer.Base64(s)
@@ -90,3 +110,169 @@ func (e producer) List(children ...*Node) (n *Node, err error) {
 		List:        children,
 	}, nil
 }
+
+// ChunkedHex splits data into a list of hexadecimal nodes of at most chunkSize
+// octets each; JoinHex reassembles it.
+func ChunkedHex(data []byte, chunkSize int) (n *Node, err error) {
+	if chunkSize <= 0 {
+		err = ErrInvalidChunkSize
+		return
+	}
+
+	children := make([]*Node, 0, (len(data)+chunkSize-1)/chunkSize)
+	for len(data) > 0 {
+		size := chunkSize
+		if size > len(data) {
+			size = len(data)
+		}
+
+		var c *Node
+		c, err = LimitedProducer.Hexadecimal(data[:size])
+		if err != nil {
+			return
+		}
+		children = append(children, c)
+
+		data = data[size:]
+	}
+
+	return LimitedProducer.List(children...)
+}
+
+// JoinHex concatenates the octet strings of a list of hexadecimal nodes.
+func JoinHex(n *Node) (data []byte, err error) {
+	if n == nil || n.Kind != KindList {
+		err = ErrNotList
+		return
+	}
+
+	size := 0
+	for _, c := range n.List {
+		if c == nil || c.Kind != KindHexadecimal {
+			err = ErrUnexpectedKind
+			return
+		}
+		size += len(c.OctetString)
+	}
+
+	data = make([]byte, 0, size)
+	for _, c := range n.List {
+		data = append(data, c.OctetString...)
+	}
+	return
+}
+
+// NewNode builds a node of any kind from raw fields, rejecting combinations that
+// do not make sense for the kind: octets on a list, children on an atom, or an
+// invalid token. children must not be nil but are not validated recursively.
+func NewNode(kind Kind, octets []byte, list []*Node) (n *Node, err error) {
+	n = &Node{
+		Kind:        kind,
+		OctetString: octets,
+		List:        list,
+	}
+
+	err = n.check()
+	if err != nil {
+		n = nil
+		return
+	}
+
+	for _, c := range list {
+		if c == nil {
+			n, err = nil, ErrInvalidNode
+			return
+		}
+	}
+	return
+}
+
+// EscapeAtom returns s as a token when it is one, and otherwise as a base-64
+// node, which holds any octets; this package has no quoted-string form.
+func EscapeAtom(s string) (n *Node) {
+	if s != "" && isToken([]byte(s)) {
+		return MustToken(s)
+	}
+	return MustBase64([]byte(s))
+}
+
+// TokenInterner builds token nodes whose OctetString is shared between all tokens
+// with the same text, so large generated trees hold one copy of each. the shared
+// bytes must be treated as immutable: writing through one node's OctetString
+// changes every token interned from the same string. each call still returns a
+// distinct Node. the zero value is ready to use; it is not safe for concurrent use.
+type TokenInterner struct {
+	octets map[string][]byte
+}
+
+// Token returns a token node for s, panicking like MustToken if s is not a valid
+// token.
+func (ti *TokenInterner) Token(s string) (n *Node) {
+	b, ok := ti.octets[s]
+	if !ok {
+		if s == "" || !isToken([]byte(s)) {
+			panic(ErrInvalidTokenChar)
+		}
+		if ti.octets == nil {
+			ti.octets = make(map[string][]byte)
+		}
+
+		b = []byte(s)
+		// full slice so that an append on one node cannot write into the others:
+		b = b[:len(b):len(b)]
+		ti.octets[s] = b
+	}
+
+	return &Node{
+		Kind:        KindToken,
+		OctetString: b,
+		List:        nil,
+	}
+}
+
+// Raw wraps encoded, which must be exactly one serialized expression with no
+// surrounding whitespace, in a node that String writes out verbatim, so that a
+// known fragment can be spliced into a tree without building its nodes. the
+// fragment is opaque: Minify leaves it as is, Equal compares its bytes, and the
+// tree helpers do not look inside it.
+func Raw(encoded []byte) (n *Node, err error) {
+	err = checkRaw(encoded)
+	if err != nil {
+		return
+	}
+
+	return RawUnchecked(encoded), nil
+}
+
+// checkRaw fails unless encoded is exactly one expression that spans the whole
+// slice; surrounding whitespace would leave the splice out of normalized form.
+func checkRaw(encoded []byte) (err error) {
+	_, err = parseOne(encoded)
+	if err == io.EOF {
+		// nothing but whitespace:
+		err = ErrInvalidNode
+	}
+	if err != nil {
+		return
+	}
+
+	for _, c := range []byte{encoded[0], encoded[len(encoded)-1]} {
+		if discard, _ := LimitedParser.shouldDiscard(rune(c)); discard {
+			err = ErrInvalidNode
+			return
+		}
+	}
+	return
+}
+
+// RawUnchecked is Raw without the check that encoded is a valid expression. an
+// invalid fragment makes the whole serialization invalid, or changes its meaning,
+// without any error being reported until it is parsed back; use it only for
+// bytes known to come from String.
+func RawUnchecked(encoded []byte) (n *Node) {
+	return &Node{
+		Kind:        KindRaw,
+		OctetString: encoded,
+		List:        nil,
+	}
+}
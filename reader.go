@@ -0,0 +1,191 @@
+package sexp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// Reader returns an io.Reader that produces the same bytes as String(), but
+// serializes n incrementally as it is read instead of all at once. a node that
+// cannot be serialized makes Read return the error String() would report.
+func (n *Node) Reader() io.Reader {
+	r := &nodeReader{
+		parents: make(map[*Node]struct{}),
+	}
+	r.push(n)
+	return r
+}
+
+type nodeReaderFrame struct {
+	n    *Node
+	next int
+}
+
+type nodeReader struct {
+	buf   []byte
+	stack []nodeReaderFrame
+	err   error
+
+	// atom is the atom being encoded, next octets at a time, so that a large
+	// one is never held in encoded form all at once
+	atom *Node
+	next int
+
+	// parents holds the lists on the stack for cycle detection
+	parents map[*Node]struct{}
+}
+
+func (r *nodeReader) Read(p []byte) (n int, err error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.atom != nil {
+			r.stepAtom()
+			continue
+		}
+		if len(r.stack) == 0 {
+			return 0, io.EOF
+		}
+		r.step()
+	}
+
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+// push starts serializing c, opening a new frame if it is a list
+func (r *nodeReader) push(c *Node) {
+	if c != nil && c.Kind != KindList {
+		r.pushAtom(c)
+		return
+	}
+	if c == nil {
+		var sb strings.Builder
+		r.err = c.appendToBuilder(&sb, r.parents)
+		r.buf = append(r.buf, sb.String()...)
+		return
+	}
+
+	if _, ok := r.parents[c]; ok {
+		r.err = ErrCycleDetected
+		return
+	}
+	r.parents[c] = struct{}{}
+
+	r.buf = append(r.buf, '(')
+	r.stack = append(r.stack, nodeReaderFrame{n: c})
+}
+
+// step emits the next child of the innermost list or closes it
+func (r *nodeReader) step() {
+	top := &r.stack[len(r.stack)-1]
+	if top.next >= len(top.n.List) {
+		r.buf = append(r.buf, ')')
+		delete(r.parents, top.n)
+		r.stack = r.stack[:len(r.stack)-1]
+		return
+	}
+
+	if top.next > 0 {
+		r.buf = append(r.buf, ' ')
+	}
+	c := top.n.List[top.next]
+	top.next++
+
+	r.push(c)
+}
+
+// pushAtom starts encoding c, writing only its prefix now. the checks match
+// appendToBuilder's.
+func (r *nodeReader) pushAtom(c *Node) {
+	var sb strings.Builder
+	switch c.Kind {
+	case KindToken:
+		if len(c.OctetString) == 0 || !isToken(c.OctetString) {
+			r.err = ErrInvalidTokenChar
+			return
+		}
+	case KindHexadecimal, KindBase64:
+		r.err = c.appendHint(&sb)
+		if r.err != nil {
+			return
+		}
+		if c.Kind == KindHexadecimal {
+			sb.WriteRune('#')
+		} else {
+			sb.WriteRune('|')
+		}
+	case KindRaw:
+	default:
+		// unknown kinds serialize as appendToBuilder does:
+		r.err = c.appendToBuilder(&sb, r.parents)
+		r.buf = append(r.buf, sb.String()...)
+		return
+	}
+
+	r.buf = append(r.buf, sb.String()...)
+	r.atom, r.next = c, 0
+}
+
+// atomChunk is the number of octets encoded per step; a multiple of 3 so that
+// base-64 chunks need no padding until the last one.
+const atomChunk = 48
+
+// stepAtom encodes the next chunk of the current atom, closing it after the last
+func (r *nodeReader) stepAtom() {
+	c := r.atom
+	rest := c.OctetString[r.next:]
+	if len(rest) > atomChunk {
+		rest = rest[:atomChunk]
+	}
+	r.next += len(rest)
+
+	switch c.Kind {
+	case KindHexadecimal:
+		size := hex.EncodedLen(len(rest))
+		r.buf = append(r.buf, make([]byte, size)...)
+		hex.Encode(r.buf[len(r.buf)-size:], rest)
+	case KindBase64:
+		size := base64.StdEncoding.EncodedLen(len(rest))
+		r.buf = append(r.buf, make([]byte, size)...)
+		base64.StdEncoding.Encode(r.buf[len(r.buf)-size:], rest)
+	default:
+		r.buf = append(r.buf, rest...)
+	}
+
+	if r.next < len(c.OctetString) {
+		return
+	}
+	switch c.Kind {
+	case KindHexadecimal:
+		r.buf = append(r.buf, '#')
+	case KindBase64:
+		r.buf = append(r.buf, '|')
+	}
+	r.atom = nil
+}
+
+// StringN is like String but stops after maxBytes of output, appending `...`
+// when the serialized form was cut short. useful for bounded logging: only about
+// maxBytes of the serialized form are ever produced, even within a large atom.
+func (n *Node) StringN(maxBytes int) string {
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+
+	var sb strings.Builder
+	_, err := io.Copy(&sb, io.LimitReader(n.Reader(), int64(maxBytes)+1))
+	if err != nil {
+		return "!!(" + err.Error() + ")!!"
+	}
+
+	s := sb.String()
+	if len(s) > maxBytes {
+		return s[:maxBytes] + "..."
+	}
+	return s
+}
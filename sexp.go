@@ -1,11 +1,15 @@
 package sexp
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unsafe"
 )
 
 // author: jsd1982
@@ -29,6 +33,10 @@ import (
 //   2. hexadecimal		(#616263#)
 //   3. base-64			(|YWJj|)
 
+// tokens follow section 4.3 of the spec: they consist of ASCII letters, digits and the
+// eight punctuation marks `- . / _ : * + =`, and may not begin with a digit. `:` is an
+// ordinary token character, even in leading position.
+
 // unsupported octet-string encodings:
 //   1. verbatim (aka raw)
 //   2. quoted
@@ -40,6 +48,13 @@ import (
 // Transformation Format but must be done with either hexadecimal or base-64 encoded
 // octet-strings, NOT in token octet-strings.
 
+// hexadecimal and base-64 octet-strings are 8-bit clean: any octets 0x00-0xFF
+// round-trip unchanged, since only their ASCII encoding ever reaches the input. in
+// the serialized form itself, only space, tab, vertical tab and form feed are
+// skipped as whitespace (plus '\r' and '\n' for FullParser); any other control
+// character is unexpected and any byte 0x80-0xFF fails with ErrNotASCII,
+// whether or not it is part of a valid UTF-8 sequence.
+
 type Kind int
 
 var (
@@ -48,25 +63,86 @@ var (
 	ErrUnexpectedChar              = errors.New("unexpected character")
 	ErrInvalidLengthPrefix         = errors.New("invalid length prefix")
 	ErrInvalidTokenChar            = errors.New("invalid token character")
+	ErrCycleDetected               = errors.New("cycle detected in list")
+	ErrInvalidConversion           = errors.New("invalid kind conversion")
+	ErrNotList                     = errors.New("node is not a list")
+	ErrMalformedPair               = errors.New("malformed key/value pair")
+	ErrInvalidNode                 = errors.New("invalid node")
+	ErrInputTooLarge               = errors.New("input too large")
+	ErrMergeConflict               = errors.New("cannot merge list with atom")
+	ErrInvalidChunkSize            = errors.New("chunk size must be positive")
+	ErrUnexpectedKind              = errors.New("unexpected node kind")
+	ErrUnbalancedParen             = errors.New("unbalanced parenthesis")
+	ErrDuplicateKey                = errors.New("duplicate key")
+	ErrEmptyList                   = errors.New("empty list")
+	ErrNotCanonical                = errors.New("not in canonical form")
+	ErrLimitReached                = errors.New("expression limit reached")
+	ErrLookaheadLost               = errors.New("lookahead rune could not be unread; use Lookahead")
+	ErrInvalidLimit                = errors.New("limit must be positive")
 )
 
+// UnbalancedParenError is returned for a `)` with no list to close and for the
+// end of input inside a list. Offset is the byte offset of that `)`, or of the
+// `(` left open, counted from where the ParseNode call started reading. it
+// matches ErrUnbalancedParen with errors.Is.
+type UnbalancedParenError struct {
+	Offset int64
+}
+
+func (e *UnbalancedParenError) Error() string {
+	return fmt.Sprintf("%s at offset %d", ErrUnbalancedParen, e.Offset)
+}
+
+func (e *UnbalancedParenError) Unwrap() error {
+	return ErrUnbalancedParen
+}
+
 const (
 	KindList Kind = iota
 	KindToken
 	KindHexadecimal
 	KindBase64
+	// KindRaw holds an already-serialized expression in OctetString, written out
+	// verbatim; see Raw. the parser never produces it.
+	KindRaw
 )
 
 type Node struct {
 	Kind
 	OctetString []byte
 	List        []*Node
+	// Hint is the length prefix written before a hexadecimal or base-64 octet-string
+	Hint LengthHint
 }
 
 func (n *Node) String() string {
+	str, err := n.serialize()
+	if err != nil {
+		return "!!(" + err.Error() + ")!!"
+	}
+
+	return str
+}
+
+func (n *Node) serialize() (str string, err error) {
+	var sb strings.Builder
+
+	err = n.appendToBuilder(&sb, make(map[*Node]struct{}))
+	if err != nil {
+		return
+	}
+
+	str = sb.String()
+	return
+}
+
+// Minify returns the shortest serialization of n: length prefixes are dropped
+// and list elements are only separated where they would otherwise run together,
+// which is between two tokens. errors are reported the same way as String().
+func (n *Node) Minify() string {
 	var sb strings.Builder
 
-	err := n.appendToBuilder(&sb)
+	err := n.appendMinified(&sb, make(map[*Node]struct{}))
 	if err != nil {
 		return "!!(" + err.Error() + ")!!"
 	}
@@ -74,16 +150,77 @@ func (n *Node) String() string {
 	return sb.String()
 }
 
-func (n *Node) appendToBuilder(sb *strings.Builder) (err error) {
+func (n *Node) appendMinified(sb *strings.Builder, parents map[*Node]struct{}) (err error) {
+	if n == nil {
+		return
+	}
+
+	if n.Kind != KindList {
+		c := *n
+		c.Hint = LengthHint{}
+		return c.appendToBuilder(sb, parents)
+	}
+
+	if _, ok := parents[n]; ok {
+		err = ErrCycleDetected
+		return
+	}
+	parents[n] = struct{}{}
+	defer delete(parents, n)
+
+	sb.WriteRune('(')
+	var prev *Node
+	for _, c := range n.List {
+		// a token runs on until a non-token char so needs a space before another token;
+		// a raw fragment may start or end with one:
+		if prev != nil && (prev.Kind == KindToken || prev.Kind == KindRaw) && c != nil && (c.Kind == KindToken || c.Kind == KindRaw) {
+			sb.WriteRune(' ')
+		}
+		err = c.appendMinified(sb, parents)
+		if err != nil {
+			return
+		}
+		if c != nil {
+			prev = c
+		}
+	}
+	sb.WriteRune(')')
+	return
+}
+
+// MarshalBase64Wrapped serializes n and base-64 encodes the whole expression for
+// transports that carry it as one opaque string; see ParseBase64Wrapped. this is
+// unrelated to base-64 octet-string atoms (|...|) inside an expression.
+func MarshalBase64Wrapped(n *Node) (s string, err error) {
+	var str string
+	str, err = n.serialize()
+	if err != nil {
+		return
+	}
+
+	s = base64.StdEncoding.EncodeToString([]byte(str))
+	return
+}
+
+// parents holds the lists currently being serialized above n; shared subtrees
+// are fine but a list that contains itself would recurse forever.
+func (n *Node) appendToBuilder(sb *strings.Builder, parents map[*Node]struct{}) (err error) {
 	if n == nil {
 		return
 	}
 
 	switch n.Kind {
 	case KindList:
+		if _, ok := parents[n]; ok {
+			err = ErrCycleDetected
+			return
+		}
+		parents[n] = struct{}{}
+		defer delete(parents, n)
+
 		sb.WriteRune('(')
 		for i, c := range n.List {
-			err = c.appendToBuilder(sb)
+			err = c.appendToBuilder(sb, parents)
 			if err != nil {
 				return
 			}
@@ -94,9 +231,18 @@ func (n *Node) appendToBuilder(sb *strings.Builder) (err error) {
 		sb.WriteRune(')')
 		return
 	case KindToken:
+		// the parser would not read back an empty or malformed token:
+		if len(n.OctetString) == 0 || !isToken(n.OctetString) {
+			err = ErrInvalidTokenChar
+			return
+		}
 		sb.Write(n.OctetString)
 		return
 	case KindHexadecimal:
+		err = n.appendHint(sb)
+		if err != nil {
+			return
+		}
 		sb.WriteRune('#')
 		_, err = hex.NewEncoder(sb).Write(n.OctetString)
 		if err != nil {
@@ -105,6 +251,10 @@ func (n *Node) appendToBuilder(sb *strings.Builder) (err error) {
 		sb.WriteRune('#')
 		return
 	case KindBase64:
+		err = n.appendHint(sb)
+		if err != nil {
+			return
+		}
 		sb.WriteRune('|')
 		var enc io.WriteCloser
 		enc = base64.NewEncoder(base64.StdEncoding, sb)
@@ -118,7 +268,671 @@ func (n *Node) appendToBuilder(sb *strings.Builder) (err error) {
 		}
 		sb.WriteRune('|')
 		return
+	case KindRaw:
+		sb.Write(n.OctetString)
+		return
+	}
+
+	return
+}
+
+func (n *Node) appendHint(sb *strings.Builder) (err error) {
+	if !n.Hint.Has {
+		return
+	}
+	if n.Hint.Length != uint64(len(n.OctetString)) {
+		err = ErrInvalidLengthPrefix
+		return
+	}
+
+	sb.WriteString(strconv.FormatUint(n.Hint.Length, 10))
+	return
+}
+
+// Truncate returns a copy of n where any list nested deeper than maxDepth is
+// replaced by a `...` token. the outermost list is at depth 1.
+func (n *Node) Truncate(maxDepth int) *Node {
+	return n.truncate(1, maxDepth)
+}
+
+func (n *Node) truncate(depth, maxDepth int) *Node {
+	if n == nil {
+		return nil
+	}
+
+	if n.Kind != KindList {
+		c := *n
+		return &c
+	}
+
+	if depth > maxDepth {
+		return MustToken("...")
+	}
+
+	c := &Node{
+		Kind:        KindList,
+		OctetString: nil,
+		List:        make([]*Node, len(n.List)),
+	}
+	for i, child := range n.List {
+		c.List[i] = child.truncate(depth+1, maxDepth)
+	}
+	return c
+}
+
+// ConvertTo changes the kind of an atom node in place, keeping its octet string.
+// lists cannot be converted to or from atoms, and converting to a token requires
+// the octet string to be a valid, non-empty token. tokens carry no length
+// prefix, so converting to one clears Hint.
+func (n *Node) ConvertTo(k Kind) (err error) {
+	if n.Kind == k {
+		return
+	}
+	if n.Kind == KindRaw {
+		err = ErrInvalidConversion
+		return
+	}
+
+	switch k {
+	case KindToken:
+		if n.Kind == KindList {
+			err = ErrInvalidConversion
+			return
+		}
+		if len(n.OctetString) == 0 || !isToken(n.OctetString) {
+			err = ErrInvalidTokenChar
+			return
+		}
+		n.Hint = LengthHint{}
+	case KindHexadecimal, KindBase64:
+		if n.Kind == KindList {
+			err = ErrInvalidConversion
+			return
+		}
+	default:
+		err = ErrInvalidConversion
+		return
+	}
+
+	n.Kind = k
+	return
+}
+
+// Unwrap returns the only child of a single-element list, and n itself for
+// anything else, including empty and longer lists.
+func (n *Node) Unwrap() *Node {
+	if n == nil || n.Kind != KindList || len(n.List) != 1 {
+		return n
+	}
+	return n.List[0]
+}
+
+// UnwrapDeep repeats Unwrap until the result is no longer a single-element list,
+// so that `((a))` becomes `a`. children of the result are left as they are.
+func (n *Node) UnwrapDeep() *Node {
+	visited := make(map[*Node]struct{})
+	for {
+		if _, ok := visited[n]; ok {
+			// a cycle of single-element lists has nothing at the bottom:
+			return n
+		}
+		visited[n] = struct{}{}
+
+		c := n.Unwrap()
+		if c == n {
+			return n
+		}
+		n = c
+	}
+}
+
+// Reencode returns a copy of the octet-string n in kind k, which must also be an
+// octet-string kind (hexadecimal or base-64); the octets are the same but not
+// shared. tokens and lists return ErrInvalidConversion.
+func (n *Node) Reencode(k Kind) (c *Node, err error) {
+	if n == nil {
+		err = ErrInvalidNode
+		return
+	}
+	if !isOctetKind(n.Kind) || !isOctetKind(k) {
+		err = ErrInvalidConversion
+		return
+	}
+
+	c = &Node{
+		Kind:        n.Kind,
+		OctetString: append([]byte(nil), n.OctetString...),
+		Hint:        n.Hint,
+	}
+	err = c.ConvertTo(k)
+	if err != nil {
+		c = nil
+		return
+	}
+	return
+}
+
+func isOctetKind(k Kind) bool {
+	return k == KindHexadecimal || k == KindBase64
+}
+
+// ForEachPair calls fn for each `(key value)` child of an assoc list n, in order.
+// every child must be a two-element list headed by a token, with a non-nil value.
+func (n *Node) ForEachPair(fn func(key string, value *Node) error) (err error) {
+	if n == nil || n.Kind != KindList {
+		err = ErrNotList
+		return
+	}
+
+	for _, c := range n.List {
+		if c == nil || c.Kind != KindList || len(c.List) != 2 {
+			err = ErrMalformedPair
+			return
+		}
+		if c.List[0] == nil || c.List[0].Kind != KindToken || c.List[1] == nil {
+			err = ErrMalformedPair
+			return
+		}
+
+		err = fn(string(c.List[0].OctetString), c.List[1])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// TokenUnsafe returns the token's octet string as a string without copying it.
+// the result aliases n.OctetString and is only valid as long as those bytes are
+// not modified. returns "" for non-token nodes.
+func (n *Node) TokenUnsafe() string {
+	if n == nil || n.Kind != KindToken || len(n.OctetString) == 0 {
+		return ""
+	}
+	return *(*string)(unsafe.Pointer(&n.OctetString))
+}
+
+// Validate checks that n and all of its descendants satisfy the invariants of
+// their kinds so that n serializes to an expression that parses back to n.
+// the returned error names the path of the first invalid node, e.g. `/1/0`.
+func (n *Node) Validate() (err error) {
+	return n.validate("/", make(map[*Node]struct{}))
+}
+
+func (n *Node) validate(path string, parents map[*Node]struct{}) (err error) {
+	err = n.check()
+	if err != nil {
+		return fmt.Errorf("node %s: %w", path, err)
+	}
+
+	if n.Kind != KindList {
+		return
+	}
+
+	if _, ok := parents[n]; ok {
+		return fmt.Errorf("node %s: %w", path, ErrCycleDetected)
+	}
+	parents[n] = struct{}{}
+	defer delete(parents, n)
+
+	if path == "/" {
+		path = ""
+	}
+	for i, c := range n.List {
+		err = c.validate(path+"/"+strconv.Itoa(i), parents)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// check validates n's own fields without descending into its children
+func (n *Node) check() (err error) {
+	if n == nil {
+		return ErrInvalidNode
+	}
+
+	switch n.Kind {
+	case KindList:
+		if n.OctetString != nil || n.Hint.Has {
+			return ErrInvalidNode
+		}
+	case KindToken:
+		if n.List != nil || n.Hint.Has {
+			return ErrInvalidNode
+		}
+		if len(n.OctetString) == 0 || !isToken(n.OctetString) {
+			return ErrInvalidTokenChar
+		}
+	case KindHexadecimal, KindBase64:
+		if n.List != nil {
+			return ErrInvalidNode
+		}
+		if n.Hint.Has && n.Hint.Length != uint64(len(n.OctetString)) {
+			return ErrInvalidLengthPrefix
+		}
+	case KindRaw:
+		if n.List != nil || n.Hint.Has {
+			return ErrInvalidNode
+		}
+		if checkRaw(n.OctetString) != nil {
+			return ErrInvalidNode
+		}
+	default:
+		return ErrInvalidNode
+	}
+
+	return
+}
+
+// GoString implements fmt.GoStringer, printing n as the Must* constructor calls
+// that would build it, e.g. `MustList(MustToken("a"), MustHexadecimal([]byte("\x01")))`.
+func (n *Node) GoString() string {
+	var sb strings.Builder
+	n.appendGoString(&sb, make(map[*Node]struct{}))
+	return sb.String()
+}
+
+func (n *Node) appendGoString(sb *strings.Builder, parents map[*Node]struct{}) {
+	if n == nil {
+		sb.WriteString("nil")
+		return
+	}
+
+	octets := "nil"
+	if n.OctetString != nil {
+		octets = fmt.Sprintf("[]byte(%q)", n.OctetString)
+	}
+
+	if n.Hint.Has {
+		fmt.Fprintf(sb, "&Node{Kind: %s, OctetString: %s, Hint: LengthHint{Has: true, Length: %d}}", kindGoString(n.Kind), octets, n.Hint.Length)
+		return
+	}
+
+	switch n.Kind {
+	case KindList:
+		if _, ok := parents[n]; ok {
+			sb.WriteString("nil /* cycle */")
+			return
+		}
+		parents[n] = struct{}{}
+		defer delete(parents, n)
+
+		sb.WriteString("MustList(")
+		for i, c := range n.List {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			c.appendGoString(sb, parents)
+		}
+		sb.WriteString(")")
+	case KindToken:
+		if len(n.OctetString) == 0 || !isToken(n.OctetString) {
+			// MustToken would panic on it:
+			fmt.Fprintf(sb, "&Node{Kind: KindToken, OctetString: %s}", octets)
+			return
+		}
+		fmt.Fprintf(sb, "MustToken(%q)", n.OctetString)
+	case KindHexadecimal:
+		fmt.Fprintf(sb, "MustHexadecimal(%s)", octets)
+	case KindBase64:
+		fmt.Fprintf(sb, "MustBase64(%s)", octets)
+	case KindRaw:
+		fmt.Fprintf(sb, "RawUnchecked(%s)", octets)
+	default:
+		fmt.Fprintf(sb, "&Node{Kind: %s, OctetString: %s}", kindGoString(n.Kind), octets)
+	}
+}
+
+// kindGoString returns the name of the constant for k, or a conversion for
+// values without one.
+func kindGoString(k Kind) string {
+	switch k {
+	case KindList:
+		return "KindList"
+	case KindToken:
+		return "KindToken"
+	case KindHexadecimal:
+		return "KindHexadecimal"
+	case KindBase64:
+		return "KindBase64"
+	case KindRaw:
+		return "KindRaw"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Equal reports whether n and other have the same kinds, octet strings, length
+// hints and children.
+func (n *Node) Equal(other *Node) bool {
+	return n.equal(other, true)
+}
+
+// EqualSemantic is like Equal but ignores length hints, which do not change the
+// decoded value of an octet-string.
+func (n *Node) EqualSemantic(other *Node) bool {
+	return n.equal(other, false)
+}
+
+func (n *Node) equal(other *Node, strict bool) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	if n.Kind != other.Kind {
+		return false
+	}
+	if strict && n.Hint != other.Hint {
+		return false
+	}
+	if !bytes.Equal(n.OctetString, other.OctetString) {
+		return false
+	}
+	if len(n.List) != len(other.List) {
+		return false
+	}
+	for i := range n.List {
+		if !n.List[i].equal(other.List[i], strict) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualAsSet compares two lists as multisets: each child of n must be Equal to a
+// distinct child of other, in any order. only the top-level order is ignored;
+// children are compared with Equal. atoms compare as with Equal.
+func (n *Node) EqualAsSet(other *Node) bool {
+	if n == nil || other == nil || n.Kind != KindList || other.Kind != KindList {
+		return n.Equal(other)
+	}
+	if len(n.List) != len(other.List) {
+		return false
+	}
+
+	used := make([]bool, len(other.List))
+outer:
+	for _, c := range n.List {
+		for j, o := range other.List {
+			if !used[j] && c.equal(o, true) {
+				used[j] = true
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Merge overlays override onto base and returns the result. when both are assoc
+// lists, each of override's pairs replaces the pair with the same key in base, or
+// is appended if base has no such key; values that are assoc lists on both sides
+// are merged recursively. a key whose value is a list on one side and an atom on
+// the other is a conflict. in every other case the result is override itself.
+// the result shares atoms and non-assoc lists with base and override.
+func Merge(base, override *Node) (n *Node, err error) {
+	if !base.isAssoc() || !override.isAssoc() {
+		n = override
+		return
+	}
+
+	n = &Node{
+		Kind:        KindList,
+		OctetString: nil,
+		List:        make([]*Node, 0, len(base.List)+len(override.List)),
+	}
+
+	index := make(map[string]int, len(base.List))
+	for _, c := range base.List {
+		index[string(c.List[0].OctetString)] = len(n.List)
+		n.List = append(n.List, MustList(c.List[0], c.List[1]))
+	}
+
+	err = override.ForEachPair(func(key string, value *Node) (err error) {
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(n.List)
+			n.List = append(n.List, MustList(MustToken(key), value))
+			return
+		}
+
+		pair := n.List[i]
+		if (pair.List[1].Kind == KindList) != (value.Kind == KindList) {
+			return fmt.Errorf("key %s: %w", key, ErrMergeConflict)
+		}
+
+		pair.List[1], err = Merge(pair.List[1], value)
+		return
+	})
+	if err != nil {
+		n = nil
+	}
+	return
+}
+
+func (n *Node) isAssoc() bool {
+	return n.ForEachPair(func(string, *Node) error { return nil }) == nil
+}
+
+type NodeStats struct {
+	NodeCount int
+	ListCount int
+	AtomCount int
+	// MaxDepth is the depth of the deepest node, counting n itself as depth 1
+	MaxDepth int
+	// EstimatedBytes is the length of n's serialized form as produced by String()
+	EstimatedBytes int
+}
+
+// Stats gathers counts, depth and serialized size of n in a single traversal. a
+// list that contains itself is not descended into again, so the counts of a
+// cyclic tree cover each list on a path once.
+func (n *Node) Stats() (st NodeStats) {
+	n.stats(1, &st, make(map[*Node]struct{}))
+	return
+}
+
+func (n *Node) stats(depth int, st *NodeStats, parents map[*Node]struct{}) {
+	if n == nil {
+		return
+	}
+	if _, ok := parents[n]; ok {
+		return
+	}
+
+	st.NodeCount++
+	if depth > st.MaxDepth {
+		st.MaxDepth = depth
+	}
+	if n.Hint.Has {
+		st.EstimatedBytes += len(strconv.FormatUint(n.Hint.Length, 10))
+	}
+
+	switch n.Kind {
+	case KindList:
+		st.ListCount++
+		st.EstimatedBytes += len("()")
+		if len(n.List) > 1 {
+			st.EstimatedBytes += len(n.List) - 1
+		}
+		parents[n] = struct{}{}
+		for _, c := range n.List {
+			c.stats(depth+1, st, parents)
+		}
+		delete(parents, n)
+	case KindToken:
+		st.AtomCount++
+		st.EstimatedBytes += len(n.OctetString)
+	case KindHexadecimal:
+		st.AtomCount++
+		st.EstimatedBytes += len("##") + hex.EncodedLen(len(n.OctetString))
+	case KindBase64:
+		st.AtomCount++
+		st.EstimatedBytes += len("||") + base64.StdEncoding.EncodedLen(len(n.OctetString))
+	case KindRaw:
+		// a fragment is opaque, so it counts as a single atom as in Leaves:
+		st.AtomCount++
+		st.EstimatedBytes += len(n.OctetString)
+	}
+}
+
+// Leaves returns every atom within n, in the order they are serialized. a list
+// that contains itself is not descended into again.
+func (n *Node) Leaves() (leaves []*Node) {
+	n.collect(func(c *Node) bool { return c.Kind != KindList }, &leaves, make(map[*Node]struct{}))
+	return
+}
+
+// Lists returns every list within n, including n itself, in pre-order. a list
+// that contains itself is not descended into again.
+func (n *Node) Lists() (lists []*Node) {
+	n.collect(func(c *Node) bool { return c.Kind == KindList }, &lists, make(map[*Node]struct{}))
+	return
+}
+
+func (n *Node) collect(pred func(*Node) bool, nodes *[]*Node, parents map[*Node]struct{}) {
+	if n == nil {
+		return
+	}
+	if _, ok := parents[n]; ok {
+		return
+	}
+
+	if pred(n) {
+		*nodes = append(*nodes, n)
+	}
+	if n.Kind != KindList {
+		return
 	}
 
+	parents[n] = struct{}{}
+	for _, c := range n.List {
+		c.collect(pred, nodes, parents)
+	}
+	delete(parents, n)
+}
+
+// RenameTokens returns a copy of n in which every token found as a key in mapping
+// is replaced by a token of the mapped value. mapped values must be valid tokens.
+func (n *Node) RenameTokens(mapping map[string]string) (c *Node, err error) {
+	for _, to := range mapping {
+		if to == "" || !isToken([]byte(to)) {
+			err = ErrInvalidTokenChar
+			return
+		}
+	}
+
+	c = n.ReplaceAll(
+		func(t *Node) bool {
+			if t.Kind != KindToken {
+				return false
+			}
+			_, ok := mapping[string(t.OctetString)]
+			return ok
+		},
+		func(t *Node) *Node {
+			return MustToken(mapping[string(t.OctetString)])
+		},
+	)
+	return
+}
+
+// ReplaceAll returns a copy of n in which every node for which pred returns true
+// is replaced by the result of replacement. the tree is rewritten bottom-up: pred
+// and replacement see the copy of a list after its children have been rewritten,
+// and the nodes returned by replacement are not examined again. a list that
+// contains itself is not descended into again; the copy keeps that inner
+// reference to the original list as is.
+func (n *Node) ReplaceAll(pred func(*Node) bool, replacement func(*Node) *Node) *Node {
+	return n.replaceAll(pred, replacement, make(map[*Node]struct{}))
+}
+
+func (n *Node) replaceAll(pred func(*Node) bool, replacement func(*Node) *Node, parents map[*Node]struct{}) *Node {
+	if n == nil {
+		return nil
+	}
+	if _, ok := parents[n]; ok {
+		return n
+	}
+
+	c := *n
+	if n.Kind == KindList {
+		parents[n] = struct{}{}
+		c.List = make([]*Node, len(n.List))
+		for i, child := range n.List {
+			c.List[i] = child.replaceAll(pred, replacement, parents)
+		}
+		delete(parents, n)
+	}
+
+	if pred(&c) {
+		return replacement(&c)
+	}
+	return &c
+}
+
+// PathOf finds target within root by pointer identity and returns its path in
+// the same form as Validate errors: child indices separated by slashes, with
+// "/" denoting root itself.
+func (root *Node) PathOf(target *Node) (path string, ok bool) {
+	if root == nil || target == nil {
+		return
+	}
+	if root == target {
+		return "/", true
+	}
+
+	var indices []int
+	if !root.pathOf(target, &indices, make(map[*Node]struct{})) {
+		return
+	}
+
+	var sb strings.Builder
+	for _, i := range indices {
+		sb.WriteRune('/')
+		sb.WriteString(strconv.Itoa(i))
+	}
+	return sb.String(), true
+}
+
+func (n *Node) pathOf(target *Node, indices *[]int, visited map[*Node]struct{}) bool {
+	if n == nil || n.Kind != KindList {
+		return false
+	}
+	if _, ok := visited[n]; ok {
+		return false
+	}
+	visited[n] = struct{}{}
+
+	for i, c := range n.List {
+		*indices = append(*indices, i)
+		if c == target || c.pathOf(target, indices, visited) {
+			return true
+		}
+		*indices = (*indices)[:len(*indices)-1]
+	}
+	return false
+}
+
+// Value returns the natural Go value of an atom: a string for a token and a
+// []byte for a hexadecimal or base-64 octet-string. lists are not atoms and
+// return ErrUnexpectedKind.
+func (n *Node) Value() (v interface{}, err error) {
+	if n == nil {
+		err = ErrInvalidNode
+		return
+	}
+
+	switch n.Kind {
+	case KindToken:
+		v = string(n.OctetString)
+	case KindHexadecimal, KindBase64:
+		v = n.OctetString
+	default:
+		err = ErrUnexpectedKind
+	}
 	return
 }
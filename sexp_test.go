@@ -1,9 +1,17 @@
 package sexp
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -25,6 +33,22 @@ func TestParse(t *testing.T) {
 			wantN:   MustList(),
 			wantErr: false,
 		},
+		{
+			name: "xfail: empty input",
+			args: args{
+				s: strings.NewReader(""),
+			},
+			wantN:   nil,
+			wantErr: true,
+		},
+		{
+			name: "xfail: whitespace-only input",
+			args: args{
+				s: strings.NewReader(" \t "),
+			},
+			wantN:   nil,
+			wantErr: true,
+		},
 		{
 			name: "xfail: mismatched end of list",
 			args: args{
@@ -228,6 +252,25 @@ func TestParse(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "xpass: padded base64",
+			args: args{
+				s: strings.NewReader("(|YQ==| 2|YWI=|)"),
+			},
+			wantN: MustList(
+				MustBase64([]byte("a")),
+				MustBase64([]byte("ab")),
+			),
+			wantErr: false,
+		},
+		{
+			name: "xfail: base64 with misplaced padding",
+			args: args{
+				s: strings.NewReader("|Y=Q=|"),
+			},
+			wantN:   nil,
+			wantErr: true,
+		},
 		{
 			name: "xfail: base64 with wrong length prefix",
 			args: args{
@@ -236,6 +279,18 @@ func TestParse(t *testing.T) {
 			wantN:   nil,
 			wantErr: true,
 		},
+		{
+			name: "xpass: list of hexadecimal and base64",
+			args: args{
+				s: strings.NewReader("(#616263# |YWJj| abc)"),
+			},
+			wantN: MustList(
+				MustHexadecimal([]byte("abc")),
+				MustBase64([]byte("abc")),
+				MustToken("abc"),
+			),
+			wantErr: false,
+		},
 		{
 			name: "xpass: list of two tokens with embedded lists",
 			args: args{
@@ -389,6 +444,26 @@ func TestNode_String(t *testing.T) {
 			),
 			want: "(abc |YWJj|)",
 		},
+		{
+			name: "token with space",
+			fields: MustList(
+				MustToken("abc"),
+				&Node{Kind: KindToken, OctetString: []byte("a b")},
+			),
+			want: "!!(" + ErrInvalidTokenChar.Error() + ")!!",
+		},
+		{
+			name:   "token with leading digit",
+			fields: &Node{Kind: KindToken, OctetString: []byte("1a")},
+			want:   "!!(" + ErrInvalidTokenChar.Error() + ")!!",
+		},
+		{
+			name: "empty token",
+			fields: MustList(
+				&Node{Kind: KindToken, OctetString: nil},
+			),
+			want: "!!(" + ErrInvalidTokenChar.Error() + ")!!",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -457,6 +532,30 @@ func TestParseMulti(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "xpass: minus sign does not introduce a length prefix",
+			args: args{
+				s: strings.NewReader("-3#616263#"),
+			},
+			wantN: []*Node{
+				MustToken("-3"),
+				MustHexadecimal([]byte("abc")),
+			},
+			wantErr: false,
+		},
+		{
+			name: "xpass: minus sign inside a list",
+			args: args{
+				s: strings.NewReader("(-3 #616263#)"),
+			},
+			wantN: []*Node{
+				MustList(
+					MustToken("-3"),
+					MustHexadecimal([]byte("abc")),
+				),
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -475,3 +574,2649 @@ func TestParseMulti(t *testing.T) {
 		})
 	}
 }
+
+func TestNode_String_Cycle(t *testing.T) {
+	shared := MustToken("s")
+	inner := MustList(shared)
+	dag := MustList(inner, inner, shared)
+	if got, want := dag.String(), "((s) (s) s)"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+
+	self := MustList(MustToken("a"))
+	self.List = append(self.List, self)
+	if got, want := self.String(), "!!("+ErrCycleDetected.Error()+")!!"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+
+	outer := MustList()
+	outer.List = append(outer.List, MustList(MustToken("b"), outer))
+	if got, want := outer.String(), "!!("+ErrCycleDetected.Error()+")!!"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+}
+
+func TestNode_Truncate(t *testing.T) {
+	n, err := Parse(strings.NewReader("(a (b (c (d))))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		want     string
+	}{
+		{name: "depth 0", maxDepth: 0, want: "..."},
+		{name: "depth 1", maxDepth: 1, want: "(a ...)"},
+		{name: "depth 2", maxDepth: 2, want: "(a (b ...))"},
+		{name: "depth 4", maxDepth: 4, want: "(a (b (c (d))))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := n.Truncate(tt.maxDepth).String(); got != tt.want {
+				t.Errorf("Truncate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, want := n.String(), "(a (b (c (d))))"; got != want {
+		t.Errorf("Truncate() modified original: %v, want %v", got, want)
+	}
+}
+
+func TestScan(t *testing.T) {
+	var got []*Node
+	err := Scan(strings.NewReader("(a)(b) (c)"), func(n *Node) error {
+		got = append(got, n)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+	want := []*Node{
+		MustList(MustToken("a")),
+		MustList(MustToken("b")),
+		MustList(MustToken("c")),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() got = %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = Scan(strings.NewReader("(a)(b)(c)"), func(n *Node) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Scan() error = %v, calls = %v, want %v, 1", err, calls, stop)
+	}
+
+	calls = 0
+	err = Scan(strings.NewReader("(a)(b"), func(n *Node) error {
+		calls++
+		return nil
+	})
+	if !errors.Is(err, ErrUnbalancedParen) || calls != 1 {
+		t.Errorf("Scan() error = %v, calls = %v, want %v, 1", err, calls, ErrUnbalancedParen)
+	}
+}
+
+func TestNode_ConvertTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       *Node
+		k       Kind
+		want    string
+		wantErr error
+	}{
+		{name: "token to hex", n: MustToken("abc"), k: KindHexadecimal, want: "#616263#"},
+		{name: "token to base64", n: MustToken("abc"), k: KindBase64, want: "|YWJj|"},
+		{name: "hex to token", n: MustHexadecimal([]byte("abc")), k: KindToken, want: "abc"},
+		{name: "base64 to hex", n: MustBase64([]byte("abc")), k: KindHexadecimal, want: "#616263#"},
+		{name: "same kind", n: MustToken("abc"), k: KindToken, want: "abc"},
+		{name: "hex to invalid token", n: MustHexadecimal([]byte("a b")), k: KindToken, wantErr: ErrInvalidTokenChar},
+		{name: "empty hex to token", n: MustHexadecimal(nil), k: KindToken, wantErr: ErrInvalidTokenChar},
+		{name: "empty base64 to token", n: MustBase64([]byte{}), k: KindToken, wantErr: ErrInvalidTokenChar},
+		{name: "hinted hex to token", n: &Node{Kind: KindHexadecimal, OctetString: []byte("abc"), Hint: LengthHint{Has: true, Length: 3}}, k: KindToken, want: "abc"},
+		{name: "list to token", n: MustList(), k: KindToken, wantErr: ErrInvalidConversion},
+		{name: "token to list", n: MustToken("abc"), k: KindList, wantErr: ErrInvalidConversion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.n.ConvertTo(tt.k)
+			if err != tt.wantErr {
+				t.Fatalf("ConvertTo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := tt.n.String(); got != tt.want {
+				t.Errorf("ConvertTo() = %v, want %v", got, tt.want)
+			}
+			if err = tt.n.Validate(); err != nil {
+				t.Errorf("Validate() after ConvertTo() error = %v", err)
+			}
+		})
+	}
+
+	n := MustToken("abc")
+	if err := n.ConvertTo(KindHexadecimal); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ConvertTo(KindToken); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n, MustToken("abc")) {
+		t.Errorf("ConvertTo() round trip = %v, want %v", n, MustToken("abc"))
+	}
+}
+
+// runeScanner hides any io.ByteScanner implementation of the wrapped reader
+type runeScanner struct {
+	io.RuneScanner
+}
+
+func TestParseToken_ByteScanner(t *testing.T) {
+	inputs := []string{
+		"abc",
+		"abc def",
+		"(abc def)",
+		"a-1*b+c:d=e/f_g.h(x)",
+		"abc#616263#",
+		"abc\xff",
+		"(abc\xc3\xa9)",
+		"(#61 62\t63# |YWJj|)",
+		"#61\xff#",
+		"|YW\xc3\xa9|",
+		"#61\n62#",
+		"#61",
+	}
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			fast := strings.NewReader(input)
+			slow := runeScanner{strings.NewReader(input)}
+			for {
+				fastN, fastErr := Parse(fast)
+				slowN, slowErr := Parse(slow)
+				if fmt.Sprint(fastErr) != fmt.Sprint(slowErr) {
+					t.Fatalf("Parse() error = %v, generic error = %v", fastErr, slowErr)
+				}
+				if !reflect.DeepEqual(fastN, slowN) {
+					t.Fatalf("Parse() gotN = %v, generic gotN = %v", fastN, slowN)
+				}
+				if fastN == nil || fastErr != nil {
+					break
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseToken(b *testing.B) {
+	token := strings.Repeat("abcdefgh", 8)
+	b.Run("ByteScanner", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = LimitedParser.ParseToken(strings.NewReader(token))
+		}
+	})
+	b.Run("RuneScanner", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = LimitedParser.ParseToken(runeScanner{strings.NewReader(token)})
+		}
+	})
+}
+
+func TestParse_PreserveHints(t *testing.T) {
+	inputs := []string{
+		"(abc #616263# |YWJj|)",
+		"(abc 3#616263# 3|YWJj|)",
+		"(3#616263# #616263# 0##)",
+	}
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			n, err := LimitedParser.WithPreserveHints(true).ParseNode(strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("ParseNode() error = %v", err)
+			}
+			if got := n.String(); got != input {
+				t.Errorf("String() = %v, want %v", got, input)
+			}
+		})
+	}
+
+	n, err := Parse(strings.NewReader("3#616263#"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if got, want := n.String(), "#616263#"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+
+	n.Hint = LengthHint{Has: true, Length: 4}
+	if got, want := n.String(), "!!("+ErrInvalidLengthPrefix.Error()+")!!"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeHexString(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "xpass: digits", s: "616263", want: []byte("abc")},
+		{name: "xpass: interior whitespace", s: "61 6 26 3", want: []byte("abc")},
+		{name: "xpass: uppercase", s: "4A4b", want: []byte("JK")},
+		{name: "xpass: empty", s: "", want: []byte{}},
+		{name: "xfail: odd length", s: "abc", wantErr: true},
+		{name: "xfail: newline", s: "61\n62", wantErr: true},
+		{name: "xfail: invalid digit", s: "6g", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeHexString([]byte(tt.s))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeHexString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeHexString() = %v, want %v", got, tt.want)
+			}
+
+			// must agree with the parser:
+			n, err := Parse(strings.NewReader("#" + tt.s + "#"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(n.OctetString, tt.want) {
+				t.Errorf("Parse() = %v, want %v", n.OctetString, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_ForEachPair(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		wantKeys []string
+		wantErr  error
+	}{
+		{name: "xpass: empty", s: "()", wantKeys: nil},
+		{name: "xpass: pairs", s: "((a x)(b #01#)(c (d e)))", wantKeys: []string{"a", "b", "c"}},
+		{name: "xfail: missing value", s: "((a))", wantErr: ErrMalformedPair},
+		{name: "xfail: extra value", s: "((a x y))", wantErr: ErrMalformedPair},
+		{name: "xfail: non-list child", s: "((a x) b)", wantErr: ErrMalformedPair},
+		{name: "xfail: non-token key", s: "((#61# x))", wantErr: ErrMalformedPair},
+		{name: "xfail: not a list", s: "a", wantErr: ErrNotList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var gotKeys []string
+			err = n.ForEachPair(func(key string, value *Node) error {
+				gotKeys = append(gotKeys, key)
+				return nil
+			})
+			if err != tt.wantErr {
+				t.Fatalf("ForEachPair() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(gotKeys, tt.wantKeys) {
+				t.Errorf("ForEachPair() keys = %v, want %v", gotKeys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestNode_TokenUnsafe(t *testing.T) {
+	tests := []struct {
+		name string
+		n    *Node
+		want string
+	}{
+		{name: "token", n: MustToken("abc"), want: "abc"},
+		{name: "empty token", n: &Node{Kind: KindToken, OctetString: []byte{}}, want: ""},
+		{name: "hexadecimal", n: MustHexadecimal([]byte("abc")), want: ""},
+		{name: "list", n: MustList(MustToken("abc")), want: ""},
+		{name: "nil", n: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.n.TokenUnsafe(); got != tt.want {
+				t.Errorf("TokenUnsafe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkNode_TokenUnsafe(b *testing.B) {
+	n := MustToken(strings.Repeat("abcdefgh", 8))
+	b.Run("TokenUnsafe", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = n.TokenUnsafe()
+		}
+	})
+	b.Run("string", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = string(n.OctetString)
+		}
+	})
+}
+
+func TestNode_Validate(t *testing.T) {
+	cycle := MustList(MustToken("a"))
+	cycle.List = append(cycle.List, MustList(cycle))
+
+	tests := []struct {
+		name     string
+		n        *Node
+		wantErr  error
+		wantPath string
+	}{
+		{
+			name: "xpass: well-formed tree",
+			n: MustList(
+				MustToken("abc"),
+				MustList(MustHexadecimal([]byte("abc")), MustBase64(nil)),
+				MustList(),
+			),
+		},
+		{
+			name:     "xfail: token with space",
+			n:        MustList(MustToken("a"), &Node{Kind: KindToken, OctetString: []byte("b c")}),
+			wantErr:  ErrInvalidTokenChar,
+			wantPath: "/1",
+		},
+		{
+			name:     "xfail: empty token",
+			n:        &Node{Kind: KindToken, OctetString: []byte{}},
+			wantErr:  ErrInvalidTokenChar,
+			wantPath: "/",
+		},
+		{
+			name:     "xfail: list with octet string",
+			n:        MustList(MustList(&Node{Kind: KindList, OctetString: []byte("a")})),
+			wantErr:  ErrInvalidNode,
+			wantPath: "/0/0",
+		},
+		{
+			name:     "xfail: token with children",
+			n:        &Node{Kind: KindToken, OctetString: []byte("a"), List: []*Node{}},
+			wantErr:  ErrInvalidNode,
+			wantPath: "/",
+		},
+		{
+			name:     "xfail: nil child",
+			n:        MustList(MustToken("a"), nil),
+			wantErr:  ErrInvalidNode,
+			wantPath: "/1",
+		},
+		{
+			name:     "xfail: wrong length hint",
+			n:        &Node{Kind: KindBase64, OctetString: []byte("abc"), Hint: LengthHint{Has: true, Length: 2}},
+			wantErr:  ErrInvalidLengthPrefix,
+			wantPath: "/",
+		},
+		{
+			name:     "xfail: unknown kind",
+			n:        &Node{Kind: Kind(-1)},
+			wantErr:  ErrInvalidNode,
+			wantPath: "/",
+		},
+		{
+			name:     "xfail: cycle",
+			n:        cycle,
+			wantErr:  ErrCycleDetected,
+			wantPath: "/1/0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.n.Validate()
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			if want := "node " + tt.wantPath + ": "; !strings.HasPrefix(err.Error(), want) {
+				t.Errorf("Validate() error = %v, want prefix %v", err, want)
+			}
+		})
+	}
+}
+
+func TestParse_MaxTotalOctets(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		s       string
+		wantErr error
+	}{
+		{name: "xpass: no limit", max: 0, s: "(#6162# #6364# |ZWZn|)"},
+		{name: "xpass: exactly at limit", max: 7, s: "(#6162# #6364# |ZWZn|)"},
+		{name: "xfail: sum past limit", max: 6, s: "(#6162# #6364# |ZWZn|)", wantErr: ErrInputTooLarge},
+		{name: "xfail: single atom past limit", max: 2, s: "#616263#", wantErr: ErrInputTooLarge},
+		{name: "xfail: huge length prefix on short body", max: 2, s: "18446744073709551615#61#", wantErr: ErrInvalidLengthPrefix},
+		// both encodings check the prefix before the budget:
+		{name: "xfail: hex prefix mismatch past limit", max: 4, s: "9#6162#", wantErr: ErrInvalidLengthPrefix},
+		{name: "xfail: base64 prefix mismatch past limit", max: 4, s: "9|YWI=|", wantErr: ErrInvalidLengthPrefix},
+		{name: "xpass: tokens do not count", max: 1, s: "(abcdef #61#)"},
+		{name: "xpass: padded base64 at limit", max: 1, s: "|YQ==|"},
+		{name: "xpass: padded base64 sum at limit", max: 3, s: "(|YQ==| |YWI=|)"},
+		{name: "xfail: padded base64 past limit", max: 2, s: "(|YQ==| |YWI=|)", wantErr: ErrInputTooLarge},
+		// a wrong prefix is reported before the body is reserved or allocated:
+		{name: "xfail: short base64 prefix on long body", max: 2, s: "1|" + strings.Repeat("YWJj", 1<<16) + "|", wantErr: ErrInvalidLengthPrefix},
+		{name: "xfail: short hex prefix on long body", max: 2, s: "1#" + strings.Repeat("61", 1<<16) + "#", wantErr: ErrInvalidLengthPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := LimitedParser.WithMaxTotalOctets(tt.max)
+			_, err := p.ParseNode(strings.NewReader(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// the budget is per ParseNode call:
+			_, err = p.ParseNode(strings.NewReader(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseNode() second call error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse_EmptyInput(t *testing.T) {
+	for _, input := range []string{"", " ", "\t\v\f "} {
+		n, err := Parse(strings.NewReader(input))
+		if n != nil || err != io.EOF {
+			t.Errorf("Parse(%q) = %v, %v, want nil, %v", input, n, err, io.EOF)
+		}
+	}
+
+	n, err := FullParser.ParseNode(strings.NewReader("\r\n "))
+	if n != nil || err != io.EOF {
+		t.Errorf("ParseNode() = %v, %v, want nil, %v", n, err, io.EOF)
+	}
+
+	// a node at the very end of the input is followed by io.EOF:
+	s := strings.NewReader("abc")
+	n, err = Parse(s)
+	if !reflect.DeepEqual(n, MustToken("abc")) || err != nil {
+		t.Errorf("Parse() = %v, %v, want abc, nil", n, err)
+	}
+	n, err = Parse(s)
+	if n != nil || err != io.EOF {
+		t.Errorf("Parse() = %v, %v, want nil, %v", n, err, io.EOF)
+	}
+}
+
+func TestNode_GoString(t *testing.T) {
+	cycle := MustList()
+	cycle.List = append(cycle.List, cycle)
+
+	tests := []struct {
+		name string
+		n    *Node
+		want string
+	}{
+		{
+			name: "tree",
+			n: MustList(
+				MustToken("a"),
+				MustHexadecimal([]byte{0x01}),
+				MustList(MustBase64([]byte("abc")), MustBase64(nil)),
+			),
+			want: `MustList(MustToken("a"), MustHexadecimal([]byte("\x01")), MustList(MustBase64([]byte("abc")), MustBase64(nil)))`,
+		},
+		{
+			name: "nil",
+			n:    nil,
+			want: `nil`,
+		},
+		{
+			name: "hint",
+			n:    &Node{Kind: KindHexadecimal, OctetString: []byte("a"), Hint: LengthHint{Has: true, Length: 1}},
+			want: `&Node{Kind: KindHexadecimal, OctetString: []byte("a"), Hint: LengthHint{Has: true, Length: 1}}`,
+		},
+		{
+			name: "hinted base64 in a list",
+			n:    MustList(&Node{Kind: KindBase64, OctetString: []byte("abc"), Hint: LengthHint{Has: true, Length: 3}}),
+			want: `MustList(&Node{Kind: KindBase64, OctetString: []byte("abc"), Hint: LengthHint{Has: true, Length: 3}})`,
+		},
+		{
+			name: "invalid token",
+			n:    MustList(&Node{Kind: KindToken, OctetString: []byte("a b")}, &Node{Kind: KindToken}),
+			want: `MustList(&Node{Kind: KindToken, OctetString: []byte("a b")}, &Node{Kind: KindToken, OctetString: nil})`,
+		},
+		{
+			name: "unknown kind",
+			n:    &Node{Kind: Kind(9)},
+			want: `&Node{Kind: Kind(9), OctetString: nil}`,
+		},
+		{
+			name: "cycle",
+			n:    cycle,
+			want: `MustList(nil /* cycle */)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprintf("%#v", tt.n); got != tt.want {
+				t.Errorf("GoString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBase64Wrapped(t *testing.T) {
+	n := MustList(MustToken("a"), MustToken("b"))
+	s, err := MarshalBase64Wrapped(n)
+	if err != nil {
+		t.Fatalf("MarshalBase64Wrapped() error = %v", err)
+	}
+	if want := "KGEgYik="; s != want {
+		t.Errorf("MarshalBase64Wrapped() = %v, want %v", s, want)
+	}
+
+	got, err := ParseBase64Wrapped(s)
+	if err != nil {
+		t.Fatalf("ParseBase64Wrapped() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, n) {
+		t.Errorf("ParseBase64Wrapped() = %v, want %v", got, n)
+	}
+
+	tests := []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "xpass: trailing whitespace", s: "KGEgYikg"},
+		{name: "xfail: not base64", s: "(a b)", wantErr: true},
+		{name: "xfail: empty", s: "", wantErr: true},
+		{name: "xfail: two expressions", s: "KGEpKGIp", wantErr: true},
+		{name: "xfail: unterminated", s: "KGEgYg==", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseBase64Wrapped(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseBase64Wrapped() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cycle := MustList()
+	cycle.List = append(cycle.List, cycle)
+	if _, err = MarshalBase64Wrapped(cycle); err != ErrCycleDetected {
+		t.Errorf("MarshalBase64Wrapped() error = %v, wantErr %v", err, ErrCycleDetected)
+	}
+}
+
+func TestNode_Equal(t *testing.T) {
+	p := LimitedParser.WithPreserveHints(true)
+	parse := func(s string) *Node {
+		n, err := p.ParseNode(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("ParseNode(%q) error = %v", s, err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name         string
+		a, b         *Node
+		wantEqual    bool
+		wantSemantic bool
+	}{
+		{name: "same", a: parse("(a #616263#)"), b: parse("(a #616263#)"), wantEqual: true, wantSemantic: true},
+		{name: "hint vs whitespace", a: parse("3#616263#"), b: parse("#61 62 63#"), wantEqual: false, wantSemantic: true},
+		{name: "nested hint", a: parse("(a (3|YWJj|))"), b: parse("(a (|YWJj|))"), wantEqual: false, wantSemantic: true},
+		{name: "different kind", a: parse("#616263#"), b: parse("|YWJj|"), wantEqual: false, wantSemantic: false},
+		{name: "different octets", a: parse("abc"), b: parse("abd"), wantEqual: false, wantSemantic: false},
+		{name: "different length", a: parse("(a b)"), b: parse("(a)"), wantEqual: false, wantSemantic: false},
+		{name: "nil vs empty octets", a: MustBase64(nil), b: MustBase64([]byte{}), wantEqual: true, wantSemantic: true},
+		{name: "nil vs node", a: nil, b: MustList(), wantEqual: false, wantSemantic: false},
+		{name: "nil vs nil", a: nil, b: nil, wantEqual: true, wantSemantic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.wantEqual {
+				t.Errorf("Equal() = %v, want %v", got, tt.wantEqual)
+			}
+			if got := tt.a.EqualSemantic(tt.b); got != tt.wantSemantic {
+				t.Errorf("EqualSemantic() = %v, want %v", got, tt.wantSemantic)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		override string
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "xpass: replace and append",
+			base:     "((a x)(b y))",
+			override: "((b z)(c w))",
+			want:     "((a x) (b z) (c w))",
+		},
+		{
+			name:     "xpass: deep merge",
+			base:     "((db ((host h)(port p))) (log on))",
+			override: "((db ((port q)(user u))))",
+			want:     "((db ((host h) (port q) (user u))) (log on))",
+		},
+		{
+			name:     "xpass: scalar lists replaced wholesale",
+			base:     "((tags (a b c)))",
+			override: "((tags (d)))",
+			want:     "((tags (d)))",
+		},
+		{
+			name:     "xpass: empty override",
+			base:     "((a x))",
+			override: "()",
+			want:     "((a x))",
+		},
+		{
+			name:     "xpass: non-assoc override",
+			base:     "((a x))",
+			override: "(a b)",
+			want:     "(a b)",
+		},
+		{
+			name:     "xpass: atoms",
+			base:     "a",
+			override: "#62#",
+			want:     "#62#",
+		},
+		{
+			name:     "xfail: list replaced by atom",
+			base:     "((a (x y)))",
+			override: "((a z))",
+			wantErr:  ErrMergeConflict,
+		},
+		{
+			name:     "xfail: atom replaced by list",
+			base:     "((a ((b c))))",
+			override: "((a ((b (d)))))",
+			wantErr:  ErrMergeConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := Parse(strings.NewReader(tt.base))
+			if err != nil {
+				t.Fatal(err)
+			}
+			override, err := Parse(strings.NewReader(tt.override))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := base.String()
+			got, err := Merge(base, override)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Merge() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("Merge() = %v, want %v", got, tt.want)
+			}
+			if base.String() != before {
+				t.Errorf("Merge() modified base: %v, want %v", base, before)
+			}
+		})
+	}
+
+	// a hand-built pair with a nil value is not a pair, so Merge does not look
+	// inside it:
+	override := MustList(MustList(MustToken("a"), nil))
+	if got, err := Merge(MustList(MustList(MustToken("a"), MustToken("x"))), override); err != nil || got != override {
+		t.Errorf("Merge() = %v, %v, want override, nil", got, err)
+	}
+}
+
+func TestParse_LengthPrefixWithoutOctetString(t *testing.T) {
+	tests := []struct {
+		name     string
+		s        string
+		wantErr  error
+		wantNext rune
+	}{
+		{name: "token", s: "3abc", wantErr: ErrUnexpectedChar, wantNext: 'a'},
+		{name: "list", s: "5(a)", wantErr: ErrUnexpectedChar, wantNext: '('},
+		{name: "whitespace", s: "3 #616263#", wantErr: ErrUnexpectedChar, wantNext: ' '},
+		{name: "unsupported char", s: "3{YWJj}", wantErr: ErrUnexpectedChar, wantNext: '{'},
+		{name: "no length prefix", s: "{YWJj}", wantErr: ErrUnexpectedChar, wantNext: '{'},
+		{name: "eof", s: "3", wantErr: io.ErrUnexpectedEOF, wantNext: -1},
+		{name: "eof in list", s: "(a 12", wantErr: io.ErrUnexpectedEOF, wantNext: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := strings.NewReader(tt.s)
+			n, err := Parse(s)
+			if n != nil || err != tt.wantErr {
+				t.Fatalf("Parse() = %v, %v, want nil, %v", n, err, tt.wantErr)
+			}
+
+			next, _, err := s.ReadRune()
+			if err != nil {
+				next = -1
+			}
+			if next != tt.wantNext {
+				t.Errorf("next rune = %q, want %q", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestChunkedHex(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	n, err := ChunkedHex(data, 256)
+	if err != nil {
+		t.Fatalf("ChunkedHex() error = %v", err)
+	}
+	if len(n.List) != 4 {
+		t.Fatalf("ChunkedHex() chunks = %v, want 4", len(n.List))
+	}
+	for i, c := range n.List {
+		want := 256
+		if i == 3 {
+			want = 1000 - 3*256
+		}
+		if c.Kind != KindHexadecimal || len(c.OctetString) != want {
+			t.Errorf("ChunkedHex() chunk %d = kind %v len %v, want kind %v len %v", i, c.Kind, len(c.OctetString), KindHexadecimal, want)
+		}
+	}
+
+	// round trip through the wire format:
+	n, err = Parse(strings.NewReader(n.String()))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got, err := JoinHex(n)
+	if err != nil {
+		t.Fatalf("JoinHex() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, data) {
+		t.Errorf("JoinHex() = %v, want %v", got, data)
+	}
+
+	if n, err = ChunkedHex(nil, 256); err != nil || n.String() != "()" {
+		t.Errorf("ChunkedHex() = %v, %v, want (), nil", n, err)
+	}
+	if _, err = ChunkedHex(data, 0); err != ErrInvalidChunkSize {
+		t.Errorf("ChunkedHex() error = %v, want %v", err, ErrInvalidChunkSize)
+	}
+	if _, err = JoinHex(MustList(MustHexadecimal(data), MustToken("a"))); err != ErrUnexpectedKind {
+		t.Errorf("JoinHex() error = %v, want %v", err, ErrUnexpectedKind)
+	}
+	if _, err = JoinHex(MustHexadecimal(data)); err != ErrNotList {
+		t.Errorf("JoinHex() error = %v, want %v", err, ErrNotList)
+	}
+}
+
+func TestNode_Stats(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want NodeStats
+	}{
+		{
+			name: "token",
+			s:    "abc",
+			want: NodeStats{NodeCount: 1, ListCount: 0, AtomCount: 1, MaxDepth: 1, EstimatedBytes: 3},
+		},
+		{
+			name: "empty list",
+			s:    "()",
+			want: NodeStats{NodeCount: 1, ListCount: 1, AtomCount: 0, MaxDepth: 1, EstimatedBytes: 2},
+		},
+		{
+			name: "tree",
+			s:    "(abc (#616263# |YWJj|) (() d))",
+			want: NodeStats{NodeCount: 8, ListCount: 4, AtomCount: 4, MaxDepth: 3, EstimatedBytes: 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := n.Stats()
+			if got != tt.want {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.want)
+			}
+			if got.EstimatedBytes != len(n.String()) {
+				t.Errorf("Stats().EstimatedBytes = %v, want len(String()) = %v", got.EstimatedBytes, len(n.String()))
+			}
+		})
+	}
+
+	n, err := LimitedParser.WithPreserveHints(true).ParseNode(strings.NewReader("(3#616263# 3|YWJj|)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.Stats().EstimatedBytes, len(n.String()); got != want {
+		t.Errorf("Stats().EstimatedBytes = %v, want %v", got, want)
+	}
+
+	n = MustList(MustToken("a"), RawUnchecked([]byte("(b #62# c)")))
+	got := n.Stats()
+	if want := (NodeStats{NodeCount: 3, ListCount: 1, AtomCount: 2, MaxDepth: 2, EstimatedBytes: 14}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+	if got.NodeCount != got.ListCount+got.AtomCount {
+		t.Errorf("Stats() NodeCount = %v, want ListCount+AtomCount = %v", got.NodeCount, got.ListCount+got.AtomCount)
+	}
+	if got.EstimatedBytes != len(n.String()) {
+		t.Errorf("Stats().EstimatedBytes = %v, want len(String()) = %v", got.EstimatedBytes, len(n.String()))
+	}
+
+	// a cycle is not followed:
+	cycle := MustList(MustToken("a"))
+	cycle.List = append(cycle.List, cycle)
+	if got, want := cycle.Stats(), (NodeStats{NodeCount: 2, ListCount: 1, AtomCount: 1, MaxDepth: 2, EstimatedBytes: 4}); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParse_HexSeparators(t *testing.T) {
+	tests := []struct {
+		name    string
+		seps    string
+		s       string
+		want    []byte
+		wantErr bool
+	}{
+		{name: "xpass: colons", seps: ":", s: "#ab:cd:ef#", want: []byte{0xab, 0xcd, 0xef}},
+		{name: "xpass: dashes and colons", seps: ":-", s: "#ab-cd:ef#", want: []byte{0xab, 0xcd, 0xef}},
+		{name: "xpass: separators and whitespace", seps: ":", s: "#ab: cd :ef#", want: []byte{0xab, 0xcd, 0xef}},
+		{name: "xpass: in list", seps: ":", s: "(mac 6#00:11:22:33:44:55#)", want: nil},
+		{name: "xfail: not configured", seps: "", s: "#ab:cd:ef#", wantErr: true},
+		{name: "xfail: other separator", seps: "-", s: "#ab:cd:ef#", wantErr: true},
+		{name: "xfail: digit as separator", seps: "a", s: "#ab:cd#", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := LimitedParser.WithHexSeparators(tt.seps).ParseNode(strings.NewReader(tt.s))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.want != nil && !reflect.DeepEqual(n.OctetString, tt.want) {
+				t.Errorf("ParseNode() = %v, want %v", n.OctetString, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_RenameTokens(t *testing.T) {
+	n, err := Parse(strings.NewReader("((server ((host a) (port #50#))) (proxy ((host b) (hostx c))) host)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := n.String()
+
+	got, err := n.RenameTokens(map[string]string{"host": "hostname", "a": "a.example"})
+	if err != nil {
+		t.Fatalf("RenameTokens() error = %v", err)
+	}
+	want := "((server ((hostname a.example) (port #50#))) (proxy ((hostname b) (hostx c))) hostname)"
+	if got.String() != want {
+		t.Errorf("RenameTokens() = %v, want %v", got, want)
+	}
+	if n.String() != before {
+		t.Errorf("RenameTokens() modified original: %v, want %v", n, before)
+	}
+
+	// hexadecimal atoms holding the same bytes are not tokens:
+	got, err = MustList(MustHexadecimal([]byte("host"))).RenameTokens(map[string]string{"host": "x"})
+	if err != nil || got.String() != "(#686f7374#)" {
+		t.Errorf("RenameTokens() = %v, %v, want (#686f7374#), nil", got, err)
+	}
+
+	for _, to := range []string{"", "a b", "1a"} {
+		if _, err = n.RenameTokens(map[string]string{"host": to}); err != ErrInvalidTokenChar {
+			t.Errorf("RenameTokens(%q) error = %v, want %v", to, err, ErrInvalidTokenChar)
+		}
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	tests := []struct {
+		b            string
+		wantOk       bool
+		wantComplete bool
+	}{
+		{b: "", wantOk: true, wantComplete: false},
+		{b: " ", wantOk: true, wantComplete: false},
+		{b: "(", wantOk: true, wantComplete: false},
+		{b: "(a", wantOk: true, wantComplete: false},
+		{b: "(a (b #6162", wantOk: true, wantComplete: false},
+		{b: "(a 3", wantOk: true, wantComplete: false},
+		{b: "(a |YW", wantOk: true, wantComplete: false},
+		{b: "(a)", wantOk: true, wantComplete: true},
+		{b: "(a) ", wantOk: true, wantComplete: true},
+		{b: "abc", wantOk: true, wantComplete: true},
+		{b: "#616263#", wantOk: true, wantComplete: true},
+		{b: ")", wantOk: false, wantComplete: false},
+		{b: "(a))", wantOk: false, wantComplete: false},
+		{b: "(a)(b", wantOk: false, wantComplete: false},
+		{b: "(a\n", wantOk: false, wantComplete: false},
+		{b: "(a #6g", wantOk: false, wantComplete: false},
+		{b: "(a 3b", wantOk: false, wantComplete: false},
+		{b: "(a 4#616263#", wantOk: false, wantComplete: false},
+		{b: "1#61", wantOk: true, wantComplete: false},
+		{b: "1#6162", wantOk: false, wantComplete: false},
+		{b: "(a 1#616", wantOk: false, wantComplete: false},
+		{b: "3#6162 63", wantOk: true, wantComplete: false},
+		{b: "3#6162 636", wantOk: false, wantComplete: false},
+		{b: "1|YQ=", wantOk: true, wantComplete: false},
+		{b: "1|YWI", wantOk: false, wantComplete: false},
+		{b: "(2|YWJj", wantOk: false, wantComplete: false},
+		{b: "3|YWJj", wantOk: true, wantComplete: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.b, func(t *testing.T) {
+			gotOk, gotComplete := ValidatePrefix([]byte(tt.b))
+			if gotOk != tt.wantOk || gotComplete != tt.wantComplete {
+				t.Errorf("ValidatePrefix() = %v, %v, want %v, %v", gotOk, gotComplete, tt.wantOk, tt.wantComplete)
+			}
+		})
+	}
+}
+
+func TestProducer_Token(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantErr bool
+	}{
+		{s: "abc", wantErr: false},
+		{s: "a-1*b+c:d=e/f_g.h", wantErr: false},
+		{s: "", wantErr: true},
+		{s: "a b", wantErr: true},
+		{s: "1a", wantErr: true},
+		{s: "a\u00e9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			_, err := LimitedProducer.Token(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Token() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNode_PathOf(t *testing.T) {
+	c := MustToken("c")
+	inner := MustList(MustToken("b"), c)
+	root := MustList(MustToken("a"), inner)
+
+	tests := []struct {
+		name     string
+		target   *Node
+		wantPath string
+		wantOk   bool
+	}{
+		{name: "root", target: root, wantPath: "/", wantOk: true},
+		{name: "inner list", target: inner, wantPath: "/1", wantOk: true},
+		{name: "nested atom", target: c, wantPath: "/1/1", wantOk: true},
+		{name: "equal but not identical", target: MustToken("c"), wantPath: "", wantOk: false},
+		{name: "nil", target: nil, wantPath: "", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotPath, gotOk := root.PathOf(tt.target)
+			if gotPath != tt.wantPath || gotOk != tt.wantOk {
+				t.Errorf("PathOf() = %v, %v, want %v, %v", gotPath, gotOk, tt.wantPath, tt.wantOk)
+			}
+		})
+	}
+
+	// the path agrees with the one Validate reports:
+	bad := &Node{Kind: KindToken, OctetString: []byte("x y")}
+	inner.List = append(inner.List, bad)
+	path, _ := root.PathOf(bad)
+	if err := root.Validate(); err == nil || !strings.HasPrefix(err.Error(), "node "+path+": ") {
+		t.Errorf("Validate() error = %v, want path %v", err, path)
+	}
+}
+
+func TestParse_UnbalancedParen(t *testing.T) {
+	tests := []struct {
+		name       string
+		s          string
+		wantErr    error
+		wantOffset int64
+		wantNext   rune
+	}{
+		{name: "extra close", s: ")", wantErr: ErrUnbalancedParen, wantOffset: 0, wantNext: ')'},
+		{name: "extra close after whitespace", s: " \t)(a)", wantErr: ErrUnbalancedParen, wantOffset: 2, wantNext: ')'},
+		{name: "unterminated", s: "(", wantErr: ErrUnbalancedParen, wantOffset: 0, wantNext: -1},
+		{name: "unterminated after token", s: "(a b", wantErr: ErrUnbalancedParen, wantOffset: 0, wantNext: -1},
+		{name: "unterminated nested", s: "(a (b) (c", wantErr: ErrUnbalancedParen, wantOffset: 7, wantNext: -1},
+		{name: "unterminated after atoms", s: " (#6162# |YWJj| (", wantErr: ErrUnbalancedParen, wantOffset: 16, wantNext: -1},
+		{name: "unterminated atom", s: "(a #61", wantErr: io.ErrUnexpectedEOF, wantNext: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, sc := range []io.RuneScanner{strings.NewReader(tt.s), runeScanner{strings.NewReader(tt.s)}} {
+				n, err := Parse(sc)
+				if n != nil || !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Parse() = %v, %v, want nil, %v", n, err, tt.wantErr)
+				}
+
+				var perr *UnbalancedParenError
+				if errors.As(err, &perr) != (tt.wantErr == ErrUnbalancedParen) {
+					t.Fatalf("Parse() error = %#v, want an *UnbalancedParenError only for %v", err, ErrUnbalancedParen)
+				}
+				if perr != nil && perr.Offset != tt.wantOffset {
+					t.Errorf("Parse() error offset = %d, want %d", perr.Offset, tt.wantOffset)
+				}
+			}
+
+			s := strings.NewReader(tt.s)
+			_, _ = Parse(s)
+
+			next, _, err := s.ReadRune()
+			if err != nil {
+				next = -1
+			}
+			if next != tt.wantNext {
+				t.Errorf("next rune = %q, want %q", next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestNode_Reader(t *testing.T) {
+	big := MustList()
+	for i := 0; i < 1000; i++ {
+		big.List = append(big.List, MustList(
+			MustToken("item"),
+			MustHexadecimal([]byte(strings.Repeat("x", i%17))),
+			MustList(MustBase64([]byte{byte(i)}), MustList()),
+		))
+	}
+
+	tests := []struct {
+		name string
+		n    *Node
+	}{
+		{name: "large tree", n: big},
+		{name: "empty list", n: MustList()},
+		{name: "atom", n: MustToken("abc")},
+		{name: "nil", n: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			if _, err := io.Copy(&sb, tt.n.Reader()); err != nil {
+				t.Fatalf("io.Copy() error = %v", err)
+			}
+			if got, want := sb.String(), tt.n.String(); got != want {
+				t.Errorf("Reader() = %v, want %v", got, want)
+			}
+		})
+	}
+
+	cycle := MustList(MustToken("a"))
+	cycle.List = append(cycle.List, MustList(cycle))
+	bad := MustList(MustToken("a"), &Node{Kind: KindToken, OctetString: []byte("b c")})
+	for _, n := range []*Node{cycle, bad} {
+		_, err := io.Copy(io.Discard, n.Reader())
+		if want := n.String(); err == nil || want != "!!("+err.Error()+")!!" {
+			t.Errorf("io.Copy() error = %v, want error from %v", err, want)
+		}
+	}
+}
+
+func TestNode_Minify(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{s: "abc", want: "abc"},
+		{s: "()", want: "()"},
+		{s: "(a b c)", want: "(a b c)"},
+		{s: "(a (b) c)", want: "(a(b)c)"},
+		{s: "(a #616263# b |YWJj| c)", want: "(a#616263#b|YWJj|c)"},
+		{s: "(#61# #62# |YWJj| |YWJj|)", want: "(#61##62#|YWJj||YWJj|)"},
+		{s: "(3#616263# 3|YWJj| (() ()) x)", want: "(#616263#|YWJj|(()())x)"},
+		{s: "((a b) (c d))", want: "((a b)(c d))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			n, err := LimitedParser.WithPreserveHints(true).ParseNode(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := n.Minify()
+			if got != tt.want {
+				t.Errorf("Minify() = %v, want %v", got, tt.want)
+			}
+			if len(got) > len(n.String()) {
+				t.Errorf("Minify() = %v, longer than String() = %v", got, n.String())
+			}
+
+			m, err := Parse(strings.NewReader(got))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !m.EqualSemantic(n) {
+				t.Errorf("Parse(Minify()) = %v, want %v", m, n)
+			}
+		})
+	}
+
+	cycle := MustList()
+	cycle.List = append(cycle.List, cycle)
+	if got, want := cycle.Minify(), cycle.String(); got != want {
+		t.Errorf("Minify() = %v, want %v", got, want)
+	}
+}
+
+func TestParse_TokenChars(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    *Node
+		wantErr bool
+	}{
+		{s: "a:b:c", want: MustToken("a:b:c")},
+		{s: ":abc", want: MustToken(":abc")},
+		{s: "(: :: a:)", want: MustList(MustToken(":"), MustToken("::"), MustToken("a:"))},
+		{s: "-./_:*+=", want: MustToken("-./_:*+=")},
+		{s: "?abc", wantErr: true},
+		{s: "!abc", wantErr: true},
+		{s: "(a?b)", wantErr: true},
+		{s: "1abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.s))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+
+			// the producer must accept exactly the tokens the parser does:
+			if tt.want != nil && tt.want.Kind == KindToken {
+				if _, err = LimitedProducer.Token(tt.s); err != nil {
+					t.Errorf("Token() error = %v", err)
+				}
+			}
+			if tt.wantErr {
+				if _, err = LimitedProducer.Token(strings.Trim(tt.s, "()")); err == nil {
+					t.Errorf("Token() error = nil, want error")
+				}
+			}
+		})
+	}
+}
+
+func TestNode_ReplaceAll(t *testing.T) {
+	n, err := Parse(strings.NewReader("(a #01# (b #0102# (#010203# c)) |AQID|)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := n.String()
+
+	// replace every octet-string longer than two bytes with a sentinel token:
+	got := n.ReplaceAll(
+		func(c *Node) bool {
+			return c.Kind != KindList && c.Kind != KindToken && len(c.OctetString) > 2
+		},
+		func(c *Node) *Node {
+			return MustToken("big")
+		},
+	)
+	if want := "(a #01# (b #0102# (big c)) big)"; got.String() != want {
+		t.Errorf("ReplaceAll() = %v, want %v", got, want)
+	}
+	if n.String() != before {
+		t.Errorf("ReplaceAll() modified original: %v, want %v", n, before)
+	}
+
+	// lists are examined after their children have been replaced:
+	var seen []string
+	got = n.ReplaceAll(
+		func(c *Node) bool {
+			if c.Kind == KindList {
+				seen = append(seen, c.String())
+			}
+			return c.Kind == KindHexadecimal
+		},
+		func(c *Node) *Node {
+			return MustToken("x")
+		},
+	)
+	want := []string{"(x c)", "(b x (x c))", "(a x (b x (x c)) |AQID|)"}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("ReplaceAll() visited lists %v, want %v", seen, want)
+	}
+
+	// replacing a list replaces its whole subtree:
+	got = n.ReplaceAll(
+		func(c *Node) bool {
+			return c.Kind == KindList && len(c.List) == 2
+		},
+		func(c *Node) *Node {
+			return MustList()
+		},
+	)
+	if want := "(a #01# (b #0102# ()) |AQID|)"; got.String() != want {
+		t.Errorf("ReplaceAll() = %v, want %v", got, want)
+	}
+
+	// a cycle is not followed; the inner reference is kept:
+	cycle := MustList(MustToken("a"))
+	cycle.List = append(cycle.List, cycle)
+	got = cycle.ReplaceAll(
+		func(c *Node) bool { return c.Kind == KindToken },
+		func(c *Node) *Node { return MustToken("b") },
+	)
+	if got == cycle || got.List[0].String() != "b" || got.List[1] != cycle {
+		t.Errorf("ReplaceAll() of cycle = %#v", got)
+	}
+}
+
+func TestParse_AdjacentAtoms(t *testing.T) {
+	tests := []struct {
+		s    string
+		want *Node
+	}{
+		{s: "(abc#616263#)", want: MustList(MustToken("abc"), MustHexadecimal([]byte("abc")))},
+		{s: "(abc|YWJj|)", want: MustList(MustToken("abc"), MustBase64([]byte("abc")))},
+		{s: "(#616263#abc)", want: MustList(MustHexadecimal([]byte("abc")), MustToken("abc"))},
+		{s: "(|YWJj|abc)", want: MustList(MustBase64([]byte("abc")), MustToken("abc"))},
+		{s: "(#61##62#)", want: MustList(MustHexadecimal([]byte("a")), MustHexadecimal([]byte("b")))},
+		{s: "(|YWJj||YWJj|)", want: MustList(MustBase64([]byte("abc")), MustBase64([]byte("abc")))},
+		{s: "(abc(d))", want: MustList(MustToken("abc"), MustList(MustToken("d")))},
+		{s: "((d)abc)", want: MustList(MustList(MustToken("d")), MustToken("abc"))},
+		{s: "(abc 3#616263#)", want: MustList(MustToken("abc"), MustHexadecimal([]byte("abc")))},
+		{s: "(#61#3#616263#)", want: MustList(MustHexadecimal([]byte("a")), MustHexadecimal([]byte("abc")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a digit directly after a token continues the token rather than starting a length prefix:
+	got, err := Parse(strings.NewReader("(abc3#616263#)"))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if want := MustList(MustToken("abc3"), MustHexadecimal([]byte("abc"))); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+}
+
+func TestNode_RivestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		// examples from section 6.1 of rivest-sexp.txt:
+		{name: "issuer", s: "(issuer bob)", want: "(6:issuer3:bob)"},
+		{name: "subject", s: "(subject (ref alice mother))", want: "(7:subject(3:ref5:alice6:mother))"},
+		// every octet-string kind maps onto the verbatim encoding:
+		{name: "kinds", s: "(abc #616263# |YWJj| 3#616263#)", want: "(3:abc3:abc3:abc3:abc)"},
+		{name: "empty", s: "(() ##)", want: "(()0:)"},
+		{name: "raw octets", s: "#0a00ff#", want: "3:\n\x00\xff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := n.RivestCanonical()
+			if err != nil {
+				t.Fatalf("RivestCanonical() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("RivestCanonical() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	cycle := MustList()
+	cycle.List = append(cycle.List, cycle)
+	if _, err := cycle.RivestCanonical(); err != ErrCycleDetected {
+		t.Errorf("RivestCanonical() error = %v, want %v", err, ErrCycleDetected)
+	}
+}
+
+func BenchmarkParseList(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteRune('(')
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			sb.WriteRune(' ')
+		}
+		switch i % 4 {
+		case 0:
+			sb.WriteString("abc")
+		case 1:
+			sb.WriteString("#616263#")
+		case 2:
+			sb.WriteString("|YWJj|")
+		case 3:
+			sb.WriteString("()")
+		}
+	}
+	sb.WriteRune(')')
+	input := sb.String()
+
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Parse(strings.NewReader(input))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestProducer_HexString(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    *Node
+		wantErr bool
+	}{
+		{s: "616263", want: MustHexadecimal([]byte("abc"))},
+		{s: "61 62\t63", want: MustHexadecimal([]byte("abc"))},
+		{s: "", want: MustHexadecimal([]byte{})},
+		{s: "6g", wantErr: true},
+		{s: "616", wantErr: true},
+		{s: "#616263#", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := LimitedProducer.HexString(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HexString() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("HexString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := MustHexString("616263").String(); got != "#616263#" {
+		t.Errorf("MustHexString() = %v, want %v", got, "#616263#")
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	n, err := Parse(strings.NewReader("((z #01#) (a (b c)) (m x))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := n.ToOrderedMap()
+	if err != nil {
+		t.Fatalf("ToOrderedMap() error = %v", err)
+	}
+	if got, want := m.Keys(), []string{"z", "a", "m"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+	if v, ok := m.Get("a"); !ok || v.String() != "(b c)" {
+		t.Errorf("Get() = %v, %v, want (b c), true", v, ok)
+	}
+	if v, ok := m.Get("missing"); ok || v != nil {
+		t.Errorf("Get() = %v, %v, want nil, false", v, ok)
+	}
+
+	// updating keeps the position; new keys go last:
+	m.Set("a", MustToken("y"))
+	m.Set("b", MustToken("w"))
+
+	got, err := FromOrderedMap(m)
+	if err != nil {
+		t.Fatalf("FromOrderedMap() error = %v", err)
+	}
+	if want := "((z #01#) (a y) (m x) (b w))"; got.String() != want {
+		t.Errorf("FromOrderedMap() = %v, want %v", got, want)
+	}
+
+	// unmodified round trip preserves the source exactly:
+	m, _ = n.ToOrderedMap()
+	got, _ = FromOrderedMap(m)
+	if !got.Equal(n) {
+		t.Errorf("FromOrderedMap() = %v, want %v", got, n)
+	}
+
+	n, _ = Parse(strings.NewReader("((port a) (port b))"))
+	if _, err = n.ToOrderedMap(); err != ErrDuplicateKey {
+		t.Errorf("ToOrderedMap() error = %v, want %v", err, ErrDuplicateKey)
+	}
+
+	m = &OrderedMap{}
+	m.Set("a b", MustToken("x"))
+	if _, err = FromOrderedMap(m); err != ErrInvalidTokenChar {
+		t.Errorf("FromOrderedMap() error = %v, want %v", err, ErrInvalidTokenChar)
+	}
+}
+
+func TestNode_StringN(t *testing.T) {
+	huge := MustList(MustToken("data"), MustHexadecimal(make([]byte, 1<<20)))
+
+	tests := []struct {
+		name     string
+		n        *Node
+		maxBytes int
+		want     string
+	}{
+		{name: "huge hex", n: huge, maxBytes: 12, want: "(data #00000..."},
+		{name: "exact fit", n: MustList(MustToken("abc")), maxBytes: 5, want: "(abc)"},
+		{name: "one short", n: MustList(MustToken("abc")), maxBytes: 4, want: "(abc..."},
+		{name: "zero", n: MustList(MustToken("abc")), maxBytes: 0, want: "..."},
+		{name: "invalid", n: MustList(&Node{Kind: KindToken}), maxBytes: 10, want: "!!(" + ErrInvalidTokenChar.Error() + ")!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.n.StringN(tt.maxBytes); got != tt.want {
+				t.Errorf("StringN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// a huge atom is only encoded as far as the limit, not in full. read the way
+	// StringN does and check how many octets the reader has encoded:
+	for _, n := range []*Node{
+		MustHexadecimal(make([]byte, 8<<20)),
+		MustBase64(make([]byte, 8<<20)),
+		MustToken(strings.Repeat("a", 8<<20)),
+	} {
+		r := n.Reader()
+		var sb strings.Builder
+		if _, err := io.Copy(&sb, io.LimitReader(r, 16+1)); err != nil {
+			t.Fatal(err)
+		}
+		if encoded := r.(*nodeReader).next; encoded > 2*atomChunk {
+			t.Errorf("Reader() of %v encoded %d octets for 17 bytes of output, want at most %d", n.Kind, encoded, 2*atomChunk)
+		}
+
+		if got := n.StringN(16); len(got) != 16+len("...") {
+			t.Errorf("StringN() = %q, want 16 bytes and ...", got)
+		}
+	}
+}
+
+func TestNode_Value(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       *Node
+		want    interface{}
+		wantErr error
+	}{
+		{name: "token", n: MustToken("abc"), want: "abc"},
+		{name: "hexadecimal", n: MustHexadecimal([]byte{1, 2}), want: []byte{1, 2}},
+		{name: "base64", n: MustBase64([]byte("abc")), want: []byte("abc")},
+		{name: "list", n: MustList(MustToken("abc")), wantErr: ErrUnexpectedKind},
+		{name: "nil", n: nil, wantErr: ErrInvalidNode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.n.Value()
+			if err != tt.wantErr {
+				t.Fatalf("Value() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Value() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// noUnreadScanner is a RuneScanner whose UnreadRune always fails
+type noUnreadScanner struct {
+	r io.RuneReader
+}
+
+func (s noUnreadScanner) ReadRune() (r rune, size int, err error) {
+	return s.r.ReadRune()
+}
+
+func (s noUnreadScanner) UnreadRune() error {
+	return errors.New("unread not supported")
+}
+
+func TestParse_NoUnreadRune(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []*Node
+	}{
+		{
+			s: "(a b (c) #61# |YWJj| 1#62#)",
+			want: []*Node{
+				MustList(
+					MustToken("a"),
+					MustToken("b"),
+					MustList(MustToken("c")),
+					MustHexadecimal([]byte("a")),
+					MustBase64([]byte("abc")),
+					MustHexadecimal([]byte("b")),
+				),
+			},
+		},
+		{
+			s:    "abc",
+			want: []*Node{MustToken("abc")},
+		},
+		{
+			// the space after a top-level token is lost, which is harmless:
+			s:    "(a)(b) c d",
+			want: []*Node{MustList(MustToken("a")), MustList(MustToken("b")), MustToken("c"), MustToken("d")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			s := noUnreadScanner{strings.NewReader(tt.s)}
+			var got []*Node
+			for {
+				n, err := Parse(s)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Parse() error = %v", err)
+				}
+				got = append(got, n)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_Lookahead(t *testing.T) {
+	const input = "a(b c)"
+
+	// without a kept lookahead the `(` that ends the token cannot be handed back,
+	// but the token itself is still returned:
+	n, err := Parse(noUnreadScanner{strings.NewReader(input)})
+	if !reflect.DeepEqual(n, MustToken("a")) || err != ErrLookaheadLost {
+		t.Errorf("Parse() = %v, %v, want a, %v", n, err, ErrLookaheadLost)
+	}
+
+	// the multi-expression entry points keep the lookahead themselves:
+	nodes, err := ParseAllN(noUnreadScanner{strings.NewReader(input)}, 10)
+	if err != nil || len(nodes) != 2 || nodes[1].String() != "(b c)" {
+		t.Errorf("ParseAllN() = %v, %v, want [a (b c)], nil", nodes, err)
+	}
+
+	s := Lookahead(noUnreadScanner{strings.NewReader(input)})
+	if Lookahead(s) != s {
+		t.Errorf("Lookahead() wrapped a lookahead scanner again")
+	}
+	var got []string
+	for {
+		n, err = Parse(s)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+		got = append(got, n.String())
+	}
+	if want := []string{"a", "(b c)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+}
+
+func TestParse_RejectEmptyLists(t *testing.T) {
+	tests := []struct {
+		s          string
+		wantReject bool
+	}{
+		{s: "()", wantReject: true},
+		{s: "( \t )", wantReject: true},
+		{s: "(a ())", wantReject: true},
+		{s: "(a (b (c ())))", wantReject: true},
+		{s: "(a (b))", wantReject: false},
+		{s: "abc", wantReject: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			_, err := LimitedParser.ParseNode(strings.NewReader(tt.s))
+			if err != nil {
+				t.Errorf("ParseNode() error = %v by default", err)
+			}
+
+			_, err = LimitedParser.WithRejectEmptyLists(true).ParseNode(strings.NewReader(tt.s))
+			if tt.wantReject && err != ErrEmptyList {
+				t.Errorf("ParseNode() error = %v, want %v", err, ErrEmptyList)
+			}
+			if !tt.wantReject && err != nil {
+				t.Errorf("ParseNode() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestNewNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    Kind
+		octets  []byte
+		list    []*Node
+		wantErr error
+	}{
+		{name: "xpass: list", kind: KindList, list: []*Node{MustToken("a")}},
+		{name: "xpass: empty list", kind: KindList},
+		{name: "xpass: token", kind: KindToken, octets: []byte("abc")},
+		{name: "xpass: hexadecimal", kind: KindHexadecimal, octets: []byte{0, 1}},
+		{name: "xpass: empty base64", kind: KindBase64},
+		{name: "xfail: list with octets", kind: KindList, octets: []byte("a"), wantErr: ErrInvalidNode},
+		{name: "xfail: list with nil child", kind: KindList, list: []*Node{nil}, wantErr: ErrInvalidNode},
+		{name: "xfail: token with list", kind: KindToken, octets: []byte("a"), list: []*Node{}, wantErr: ErrInvalidNode},
+		{name: "xfail: hexadecimal with list", kind: KindHexadecimal, list: []*Node{MustToken("a")}, wantErr: ErrInvalidNode},
+		{name: "xfail: base64 with list", kind: KindBase64, list: []*Node{}, wantErr: ErrInvalidNode},
+		{name: "xfail: invalid token", kind: KindToken, octets: []byte("a b"), wantErr: ErrInvalidTokenChar},
+		{name: "xfail: empty token", kind: KindToken, wantErr: ErrInvalidTokenChar},
+		{name: "xfail: unknown kind", kind: Kind(99), wantErr: ErrInvalidNode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewNode(tt.kind, tt.octets, tt.list)
+			if err != tt.wantErr {
+				t.Fatalf("NewNode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if got != nil {
+					t.Errorf("NewNode() = %v, want nil", got)
+				}
+				return
+			}
+			if got.Kind != tt.kind || !reflect.DeepEqual(got.OctetString, tt.octets) || !reflect.DeepEqual(got.List, tt.list) {
+				t.Errorf("NewNode() = %#v", got)
+			}
+		})
+	}
+}
+
+func TestParse_HighBitBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+	}{
+		{name: "token", s: "abc\xe9"},
+		{name: "token utf-8", s: "abc\xc3\xa9"},
+		{name: "hexadecimal", s: "#61\xe9#"},
+		{name: "base64", s: "|YW\xc3\xa9|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, s := range []io.RuneScanner{strings.NewReader(tt.s), runeScanner{strings.NewReader(tt.s)}} {
+				n, err := Parse(s)
+				if n != nil && n.Kind == KindToken {
+					// the token ends before the first high-bit byte, which then fails on its own:
+					if string(n.OctetString) != "abc" {
+						t.Errorf("Parse() = %v, want abc", n)
+					}
+					n, err = Parse(s)
+				}
+				if n != nil || !errors.Is(err, ErrNotASCII) {
+					t.Errorf("Parse() = %v, %v, want nil, %v", n, err, ErrNotASCII)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParseHexadecimal(b *testing.B) {
+	input := "#" + strings.Repeat("0123456789abcdef", 64) + "#"
+	b.Run("ByteScanner", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			_, _ = Parse(strings.NewReader(input))
+		}
+	})
+	b.Run("RuneScanner", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			_, _ = Parse(runeScanner{strings.NewReader(input)})
+		}
+	})
+}
+
+func TestEscapeAtom(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want Kind
+	}{
+		{name: "token", s: "abc-1", want: KindToken},
+		{name: "empty", s: "", want: KindBase64},
+		{name: "spaces", s: "hello world", want: KindBase64},
+		{name: "control", s: "a\x00b\r\n\x7f", want: KindBase64},
+		{name: "high bit", s: "caf\xc3\xa9", want: KindBase64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := EscapeAtom(tt.s)
+			if n.Kind != tt.want {
+				t.Errorf("EscapeAtom() kind = %v, want %v", n.Kind, tt.want)
+			}
+			got, err := Parse(strings.NewReader(n.String()))
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", n.String(), err)
+			}
+			if string(got.OctetString) != tt.s {
+				t.Errorf("round trip = %q, want %q", got.OctetString, tt.s)
+			}
+		})
+	}
+}
+
+func TestNode_EqualAsSet(t *testing.T) {
+	parse := func(s string) *Node {
+		n, err := Parse(strings.NewReader(s))
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", s, err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{name: "same order", a: "(a b c)", b: "(a b c)", want: true},
+		{name: "reordered", a: "(a b c)", b: "(c a b)", want: true},
+		{name: "reordered duplicates", a: "(a b a)", b: "(b a a)", want: true},
+		{name: "different counts", a: "(a a b)", b: "(a b b)", want: false},
+		{name: "different lengths", a: "(a b)", b: "(a b b)", want: false},
+		{name: "nested order matters", a: "((a b) c)", b: "(c (b a))", want: false},
+		{name: "atoms", a: "abc", b: "abc", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parse(tt.a).EqualAsSet(parse(tt.b)); got != tt.want {
+				t.Errorf("EqualAsSet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_MarshalJSON(t *testing.T) {
+	type doc struct {
+		Name string `json:"name"`
+		Expr *Node  `json:"expr"`
+		None *Node  `json:"none"`
+	}
+
+	in := doc{
+		Name: "x",
+		Expr: MustList(MustToken("abc"), MustHexadecimal([]byte{0, 1}), MustBase64([]byte("a\nb"))),
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if want := `{"name":"x","expr":"(abc #0001# |YQpi|)","none":null}`; string(b) != want {
+		t.Errorf("Marshal() = %s, want %s", b, want)
+	}
+
+	var out doc
+	err = json.Unmarshal(b, &out)
+	if err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if !out.Expr.Equal(in.Expr) {
+		t.Errorf("Unmarshal() Expr = %v, want %v", out.Expr, in.Expr)
+	}
+	if out.None != nil {
+		t.Errorf("Unmarshal() None = %v, want nil", out.None)
+	}
+
+	for _, s := range []string{`{"expr":"(abc"}`, `{"expr":"a b"}`, `{"expr":["a"]}`} {
+		if err = json.Unmarshal([]byte(s), &out); err == nil {
+			t.Errorf("Unmarshal(%s) error = nil, want error", s)
+		}
+	}
+}
+
+func TestParseCanonical(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		wantErr error
+	}{
+		{name: "canonical", s: "(abc (#00ff# |YQ==|) ())", wantErr: nil},
+		{name: "token", s: "abc", wantErr: nil},
+		{name: "leading whitespace", s: " abc", wantErr: ErrNotCanonical},
+		{name: "trailing whitespace", s: "abc ", wantErr: ErrNotCanonical},
+		{name: "double space", s: "(a  b)", wantErr: ErrNotCanonical},
+		{name: "tab", s: "(a\tb)", wantErr: ErrNotCanonical},
+		{name: "space after paren", s: "( a b)", wantErr: ErrNotCanonical},
+		{name: "length prefix", s: "2#00ff#", wantErr: ErrNotCanonical},
+		{name: "uppercase hex", s: "#00FF#", wantErr: ErrNotCanonical},
+		{name: "spaced hex", s: "#00 ff#", wantErr: ErrNotCanonical},
+		{name: "invalid", s: "(abc", wantErr: ErrUnbalancedParen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := ParseCanonical([]byte(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseCanonical() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && n.String() != tt.s {
+				t.Errorf("ParseCanonical() = %v, want %v", n, tt.s)
+			}
+			if err != nil && n != nil {
+				t.Errorf("ParseCanonical() = %v, want nil", n)
+			}
+		})
+	}
+}
+
+func TestNode_LeavesLists(t *testing.T) {
+	n, err := Parse(strings.NewReader("(a (b c))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, c := range n.Leaves() {
+		got = append(got, c.String())
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Leaves() = %v, want %v", got, want)
+	}
+
+	lists := n.Lists()
+	if len(lists) != 2 || lists[0] != n || lists[1] != n.List[1] {
+		t.Errorf("Lists() = %v, want [%v %v]", lists, n, n.List[1])
+	}
+
+	if got := MustToken("a").Lists(); got != nil {
+		t.Errorf("Lists() of atom = %v, want nil", got)
+	}
+
+	// a cycle is not followed:
+	cycle := MustList(MustToken("a"))
+	cycle.List = append(cycle.List, cycle)
+	if got := cycle.Leaves(); len(got) != 1 || got[0] != cycle.List[0] {
+		t.Errorf("Leaves() of cycle = %v, want [a]", got)
+	}
+	if got := cycle.Lists(); len(got) != 1 || got[0] != cycle {
+		t.Errorf("Lists() of cycle = %v, want only the list itself", got)
+	}
+}
+
+func TestParseAllN(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		max     int
+		want    []string
+		wantErr error
+	}{
+		{name: "limited", s: "a (b) #63# d e", max: 2, want: []string{"a", "(b)"}, wantErr: ErrLimitReached},
+		{name: "exhausted", s: "a (b) ", max: 5, want: []string{"a", "(b)"}, wantErr: nil},
+		{name: "empty", s: "  ", max: 5, want: nil, wantErr: nil},
+		{name: "error", s: "a (b", max: 5, want: []string{"a"}, wantErr: ErrUnbalancedParen},
+		{name: "zero max", s: "", max: 0, want: nil, wantErr: ErrInvalidLimit},
+		{name: "negative max", s: "a", max: -1, want: nil, wantErr: ErrInvalidLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := ParseAllN(strings.NewReader(tt.s), tt.max)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseAllN() error = %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nodes {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseAllN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	conformanceTokenStart     = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-./_:*+="
+	conformanceTokenRemainder = conformanceTokenStart + "0123456789"
+)
+
+func genConformanceNode(rnd *rand.Rand, depth int) *Node {
+	k := rnd.Intn(4)
+	if depth >= 4 && k == 0 {
+		k = 1
+	}
+
+	switch k {
+	case 0:
+		children := make([]*Node, rnd.Intn(5))
+		for i := range children {
+			children[i] = genConformanceNode(rnd, depth+1)
+		}
+		return MustList(children...)
+	case 1:
+		b := []byte{conformanceTokenStart[rnd.Intn(len(conformanceTokenStart))]}
+		for i := rnd.Intn(8); i > 0; i-- {
+			b = append(b, conformanceTokenRemainder[rnd.Intn(len(conformanceTokenRemainder))])
+		}
+		return MustToken(string(b))
+	case 2:
+		b := make([]byte, rnd.Intn(8))
+		rnd.Read(b)
+		return MustHexadecimal(b)
+	default:
+		b := make([]byte, rnd.Intn(8))
+		rnd.Read(b)
+		return MustBase64(b)
+	}
+}
+
+func TestConformance_RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		n := genConformanceNode(rnd, 1)
+
+		s := n.String()
+		got, err := ParseCanonical([]byte(s))
+		if err != nil || !got.Equal(n) {
+			t.Fatalf("ParseCanonical(%q) = %v, %v; want %v", s, got, err, n)
+		}
+
+		m := n.Minify()
+		got, err = parseOne([]byte(m))
+		if err != nil || !got.Equal(n) {
+			t.Fatalf("parseOne(%q) = %v, %v; want %v", m, got, err, n)
+		}
+
+		if est := n.Stats().EstimatedBytes; est != len(s) {
+			t.Fatalf("Stats().EstimatedBytes = %d, want %d for %q", est, len(s), s)
+		}
+	}
+}
+
+func TestConformance_NearMisses(t *testing.T) {
+	mutations := []struct {
+		name   string
+		kind   Kind
+		mutate func(s string) string
+	}{
+		{name: "unclosed list", kind: KindList, mutate: func(s string) string { return s[:len(s)-1] }},
+		{name: "extra close", kind: KindList, mutate: func(s string) string { return s + ")" }},
+		{name: "digit before token", kind: KindToken, mutate: func(s string) string { return "9" + s }},
+		{name: "high bit in token", kind: KindToken, mutate: func(s string) string { return s + "\xe9" }},
+		{name: "control in token", kind: KindToken, mutate: func(s string) string { return s + "\x01" }},
+		{name: "non-hex digit", kind: KindHexadecimal, mutate: func(s string) string { return "#g" + s[1:] }},
+		{name: "odd hex digits", kind: KindHexadecimal, mutate: func(s string) string { return "#0" + s[1:] }},
+		{name: "unclosed hex", kind: KindHexadecimal, mutate: func(s string) string { return s[:len(s)-1] }},
+		{name: "non-base64 char", kind: KindBase64, mutate: func(s string) string { return "|!" + s[1:] }},
+		{name: "unclosed base64", kind: KindBase64, mutate: func(s string) string { return s[:len(s)-1] }},
+		{name: "long prefix", kind: KindBase64, mutate: func(s string) string { return "99" + s }},
+	}
+
+	rnd := rand.New(rand.NewSource(2))
+	tested := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		n := genConformanceNode(rnd, 3)
+		s := n.String()
+		for _, m := range mutations {
+			if m.kind != n.Kind {
+				continue
+			}
+
+			bad := m.mutate(s)
+			if got, err := parseOne([]byte(bad)); err == nil {
+				t.Fatalf("%s: parseOne(%q) = %v, want error", m.name, bad, got)
+			}
+			tested[m.name]++
+		}
+	}
+
+	for _, m := range mutations {
+		if tested[m.name] == 0 {
+			t.Errorf("%s: never exercised", m.name)
+		}
+	}
+}
+
+func TestConformance_ProducerAgreesWithParser(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+	for i := 0; i < 5000; i++ {
+		b := make([]byte, 1+rnd.Intn(4))
+		for j := range b {
+			b[j] = byte(rnd.Intn(0x80))
+		}
+
+		_, perr := LimitedProducer.Token(string(b))
+		n, err := parseOne(b)
+		parsed := err == nil && n.Kind == KindToken && bytes.Equal(n.OctetString, b)
+		if (perr == nil) != parsed {
+			t.Fatalf("Token(%q) error = %v, but parsed as token = %v", b, perr, parsed)
+		}
+	}
+}
+
+func TestParse_LengthHintCountsOctets(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         string
+		want      string
+		wantErr   error
+		wantInMsg string
+	}{
+		{name: "hex octets", s: "3#616263#", want: "#616263#"},
+		{name: "hex digits", s: "6#616263#", wantErr: ErrInvalidLengthPrefix, wantInMsg: "counts hex digits"},
+		{name: "hex too long", s: "4#616263#", wantErr: ErrInvalidLengthPrefix},
+		{name: "hex too short", s: "(2#616263#)", wantErr: ErrInvalidLengthPrefix},
+		{name: "base64 octets", s: "2|YWI=|", want: "|YWI=|"},
+		{name: "base64 too short", s: "(1|YWJj|)", wantErr: ErrInvalidLengthPrefix},
+		{name: "base64 characters", s: "4|YWJj|", wantErr: ErrInvalidLengthPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := Parse(strings.NewReader(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantInMsg) {
+					t.Errorf("Parse() error = %q, want it to mention %q", err, tt.wantInMsg)
+				}
+				return
+			}
+			if n.String() != tt.want {
+				t.Errorf("Parse() = %v, want %v", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_Concurrent(t *testing.T) {
+	const input = "(abc 3#616263# (|YWJj| def))"
+	p := LimitedParser.WithMaxTotalOctets(64).WithPreserveHints(true)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				n, err := p.ParseNode(strings.NewReader(input))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if n.String() != input {
+					errs <- fmt.Errorf("ParseNode() = %v, want %v", n, input)
+					return
+				}
+				if _, err = Parse(runeScanner{strings.NewReader(input)}); err != nil {
+					errs <- err
+					return
+				}
+				_ = MustList(MustToken("a"), MustHexadecimal([]byte{1}))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkParse_Parallel(b *testing.B) {
+	const input = "(abc 3#616263# (|YWJj| def))"
+	p := LimitedParser.WithMaxTotalOctets(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := p.ParseNode(strings.NewReader(input)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestParseNULDelimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []string
+		wantErr error
+	}{
+		{name: "two", s: "(a #00#)\x00b", want: []string{"(a #00#)", "b"}},
+		{name: "terminated", s: "(a #00#)\x00b\x00", want: []string{"(a #00#)", "b"}},
+		{name: "empty segments", s: "\x00a\x00\x00", want: []string{"a"}},
+		{name: "empty", s: "", want: nil},
+		{name: "two in one segment", s: "a\x00b c", want: []string{"a"}, wantErr: ErrUnexpectedChar},
+		{name: "blank segment", s: "a\x00 \x00b", want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := ParseNULDelimited(strings.NewReader(tt.s))
+			if err != tt.wantErr {
+				t.Errorf("ParseNULDelimited() error = %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nodes {
+				got = append(got, n.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseNULDelimited() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenInterner(t *testing.T) {
+	var ti TokenInterner
+	a, b := ti.Token("abc"), ti.Token("abc")
+	if a == b {
+		t.Errorf("Token() returned the same node twice")
+	}
+	if &a.OctetString[0] != &b.OctetString[0] {
+		t.Errorf("Token() did not share octets")
+	}
+	if !a.Equal(MustToken("abc")) {
+		t.Errorf("Token() = %v, want abc", a)
+	}
+	if c := ti.Token("abd"); string(c.OctetString) != "abd" {
+		t.Errorf("Token() = %v, want abd", c)
+	}
+
+	_ = append(a.OctetString, 'x')
+	if string(b.OctetString[:cap(b.OctetString)]) != "abc" {
+		t.Errorf("append through one token reached the shared array")
+	}
+
+	defer func() {
+		if r := recover(); r != ErrInvalidTokenChar {
+			t.Errorf("Token(\"1a\") panic = %v, want %v", r, ErrInvalidTokenChar)
+		}
+	}()
+	ti.Token("1a")
+}
+
+func BenchmarkTokenInterner(b *testing.B) {
+	keys := []string{"name", "value", "type", "children", "id"}
+	b.Run("MustToken", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			children := make([]*Node, 0, 1000)
+			for j := 0; j < 1000; j++ {
+				children = append(children, MustToken(keys[j%len(keys)]))
+			}
+			_ = MustList(children...)
+		}
+	})
+	b.Run("TokenInterner", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var ti TokenInterner
+			children := make([]*Node, 0, 1000)
+			for j := 0; j < 1000; j++ {
+				children = append(children, ti.Token(keys[j%len(keys)]))
+			}
+			_ = MustList(children...)
+		}
+	})
+}
+
+func TestNode_Reencode(t *testing.T) {
+	data := []byte{0x00, 0xff, 'a', '\n', 0x80}
+	hexNode := MustHexadecimal(data)
+
+	b64, err := hexNode.Reencode(KindBase64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b64.Kind != KindBase64 || !bytes.Equal(b64.OctetString, data) {
+		t.Errorf("Reencode(KindBase64) = %v, want base-64 of %x", b64, data)
+	}
+	if hexNode.Kind != KindHexadecimal {
+		t.Errorf("Reencode() changed the original to %v", hexNode.Kind)
+	}
+
+	back, err := b64.Reencode(KindHexadecimal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !back.Equal(hexNode) {
+		t.Errorf("Reencode() round trip = %v, want %v", back, hexNode)
+	}
+	back.OctetString[0] = 1
+	if b64.OctetString[0] != 0 {
+		t.Errorf("Reencode() shares octets with the original")
+	}
+
+	for _, tt := range []struct {
+		n *Node
+		k Kind
+	}{
+		{MustToken("abc"), KindHexadecimal},
+		{hexNode, KindToken},
+		{MustList(), KindBase64},
+		{hexNode, KindList},
+	} {
+		if c, err := tt.n.Reencode(tt.k); c != nil || err != ErrInvalidConversion {
+			t.Errorf("Reencode(%v) of %v = %v, %v, want %v", tt.k, tt.n, c, err, ErrInvalidConversion)
+		}
+	}
+}
+
+func TestParse_ByteRanges(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+
+	// octet-strings carry every byte value unchanged:
+	for _, n := range []*Node{MustHexadecimal(all), MustBase64(all)} {
+		got, err := Parse(strings.NewReader(n.String()))
+		if err != nil || !bytes.Equal(got.OctetString, all) {
+			t.Errorf("Parse(%v) = %v, %v; want all byte values", n.Kind, got, err)
+		}
+	}
+
+	// raw bytes in the serialized form:
+	for i := 0; i < 256; i++ {
+		c := byte(i)
+		s := "(a" + string([]byte{c}) + "b)"
+
+		var want string
+		var wantErr error
+		switch {
+		case c >= 0x80:
+			wantErr = ErrNotASCII
+		case c == '\r' || c == '\n':
+			wantErr = ErrParseUnacceptableWhitespace
+		case c == ' ' || c == '\t' || c == '\v' || c == '\f':
+			want = "(a b)"
+		case isTokenRemainder(rune(c)):
+			want = "(a" + string([]byte{c}) + "b)"
+		}
+
+		for _, sc := range []io.RuneScanner{strings.NewReader(s), runeScanner{strings.NewReader(s)}} {
+			n, err := Parse(sc)
+			switch {
+			case want != "":
+				if err != nil || n.String() != want {
+					t.Errorf("Parse(%q) = %v, %v; want %v", s, n, err, want)
+				}
+			case wantErr != nil:
+				if err != wantErr {
+					t.Errorf("Parse(%q) error = %v, want %v", s, err, wantErr)
+				}
+			default:
+				// delimiters and other control characters; ')' closes the list
+				// early and leaves a dangling one behind:
+				if err == nil && c != ')' {
+					t.Errorf("Parse(%q) = %v, want error", s, n)
+				}
+			}
+		}
+	}
+
+	// a valid multi-byte UTF-8 sequence is no different:
+	if _, err := Parse(strings.NewReader("(aéb)")); err != ErrNotASCII {
+		t.Errorf("Parse() error = %v, want %v", err, ErrNotASCII)
+	}
+}
+
+func TestParse_ErrorContext(t *testing.T) {
+	tests := []struct {
+		s       string
+		wantErr error
+		wantMsg string
+	}{
+		{s: "(a #61g2#)", wantErr: ErrUnexpectedChar, wantMsg: "parsing hex-string: "},
+		{s: "(a #616", wantErr: io.ErrUnexpectedEOF, wantMsg: "parsing hex-string: "},
+		{s: "|YW!j|", wantErr: ErrUnexpectedChar, wantMsg: "parsing base64-string: "},
+		{s: "(|YWJj\xff|)", wantErr: ErrNotASCII, wantMsg: "parsing base64-string: "},
+		{s: "2#616263#", wantErr: ErrInvalidLengthPrefix, wantMsg: "parsing hex-string: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Parse() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantMsg) {
+				t.Errorf("Parse() error = %v, want prefix %q", err, tt.wantMsg)
+			}
+		})
+	}
+
+	// the end of input is still reported bare:
+	if _, err := Parse(strings.NewReader(" ")); err != io.EOF {
+		t.Errorf("Parse() error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestNode_HashStream(t *testing.T) {
+	// large enough to pass through the writer's buffer several times:
+	children := make([]*Node, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		children = append(children, MustList(MustToken("item"), MustHexadecimal(bytes.Repeat([]byte{byte(i)}, i%64))))
+	}
+	n := MustList(children...)
+
+	h := sha256.New()
+	if err := n.HashStream(h); err != nil {
+		t.Fatalf("HashStream() error = %v", err)
+	}
+
+	canonical, err := n.RivestCanonical()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sha256.Sum256(canonical); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Errorf("HashStream() = %x, want %x", h.Sum(nil), want)
+	}
+
+	cycle := MustList()
+	cycle.List = append(cycle.List, cycle)
+	if err := cycle.HashStream(sha256.New()); err != ErrCycleDetected {
+		t.Errorf("HashStream() error = %v, want %v", err, ErrCycleDetected)
+	}
+}
+
+func TestRaw(t *testing.T) {
+	frag, err := Raw([]byte("(b #0102# c)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := MustList(MustToken("a"), frag, MustToken("d"), RawUnchecked([]byte("e")))
+	if got, want := n.String(), "(a (b #0102# c) d e)"; got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+	if got, want := n.Minify(), "(a (b #0102# c) d e)"; got != want {
+		t.Errorf("Minify() = %v, want %v", got, want)
+	}
+	var sb strings.Builder
+	if _, err = io.Copy(&sb, n.Reader()); err != nil || sb.String() != n.String() {
+		t.Errorf("Reader() = %q, %v, want %q", sb.String(), err, n.String())
+	}
+	if got, err := n.RivestCanonical(); err != nil || string(got) != "(1:a(1:b2:\x01\x021:c)1:d1:e)" {
+		t.Errorf("RivestCanonical() = %q, %v", got, err)
+	}
+	if err = n.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+
+	// round trip through the parser, which yields ordinary nodes:
+	got, err := Parse(strings.NewReader(n.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MustList(MustToken("a"), MustList(MustToken("b"), MustHexadecimal([]byte{1, 2}), MustToken("c")), MustToken("d"), MustToken("e"))
+	if !got.Equal(want) {
+		t.Errorf("Parse() = %#v, want %#v", got, want)
+	}
+
+	for _, s := range []string{"", " ", "(a", "a b", "a\nb", " a\t", "(a) ", "\r\n(a)"} {
+		if n, err := Raw([]byte(s)); n != nil || err == nil {
+			t.Errorf("Raw(%q) = %v, %v, want error", s, n, err)
+		}
+	}
+	if err = MustList(RawUnchecked([]byte("(a"))).Validate(); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("Validate() error = %v, want %v", err, ErrInvalidNode)
+	}
+	if err = MustList(RawUnchecked([]byte(" a\t"))).Validate(); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("Validate() error = %v, want %v", err, ErrInvalidNode)
+	}
+	if err = frag.ConvertTo(KindToken); err != ErrInvalidConversion {
+		t.Errorf("ConvertTo() error = %v, want %v", err, ErrInvalidConversion)
+	}
+	if got := frag.GoString(); got != `RawUnchecked([]byte("(b #0102# c)"))` {
+		t.Errorf("GoString() = %v", got)
+	}
+}
+
+func TestNode_Unwrap(t *testing.T) {
+	tests := []struct {
+		s        string
+		want     string
+		wantDeep string
+	}{
+		{s: "((a))", want: "(a)", wantDeep: "a"},
+		{s: "(a)", want: "a", wantDeep: "a"},
+		{s: "(((a b)))", want: "((a b))", wantDeep: "(a b)"},
+		{s: "(a b)", want: "(a b)", wantDeep: "(a b)"},
+		{s: "((a) (b))", want: "((a) (b))", wantDeep: "((a) (b))"},
+		{s: "()", want: "()", wantDeep: "()"},
+		{s: "a", want: "a", wantDeep: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			n, err := Parse(strings.NewReader(tt.s))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n.Unwrap().String(); got != tt.want {
+				t.Errorf("Unwrap() = %v, want %v", got, tt.want)
+			}
+			if got := n.UnwrapDeep().String(); got != tt.wantDeep {
+				t.Errorf("UnwrapDeep() = %v, want %v", got, tt.wantDeep)
+			}
+		})
+	}
+
+	cycle := MustList()
+	cycle.List = append(cycle.List, MustList(cycle))
+	if got := cycle.UnwrapDeep(); got != cycle {
+		t.Errorf("UnwrapDeep() of a cycle = %#v, want the starting node", got)
+	}
+}
+
+func TestParse_DetectDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		wantErr error
+		wantMsg string
+	}{
+		{name: "duplicate", s: "((port #50#)(port #51#))", wantErr: ErrDuplicateKey, wantMsg: `"port" at offset 13`},
+		{name: "nested duplicate", s: "(a ((x one) (y two) (x three)))", wantErr: ErrDuplicateKey, wantMsg: `"x" at offset 21`},
+		{name: "distinct", s: "((host h)(port #50#))"},
+		{name: "not assoc", s: "((port #50#)(port #51#) x)"},
+		{name: "plain list", s: "(a a a)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LimitedParser.WithDetectDuplicateKeys(true).ParseNode(strings.NewReader(tt.s))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseNode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantMsg) {
+				t.Errorf("ParseNode() error = %v, want it to mention %s", err, tt.wantMsg)
+			}
+
+			// off by default:
+			if _, err = Parse(strings.NewReader(tt.s)); err != nil {
+				t.Errorf("Parse() error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestParse_DetectDuplicateKeys_NoOffset(t *testing.T) {
+	// ParseList called directly does not track input offsets, so the pair index
+	// is reported instead:
+	s := strings.NewReader("(port #50#)(port #51#))")
+	_, err := LimitedParser.WithDetectDuplicateKeys(true).ParseList(s)
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("ParseList() error = %v, want %v", err, ErrDuplicateKey)
+	}
+	if want := `"port" in pair 1`; !strings.Contains(err.Error(), want) {
+		t.Errorf("ParseList() error = %v, want it to mention %s", err, want)
+	}
+}
+
+func TestNode_AdjacentAtoms(t *testing.T) {
+	samples := []struct {
+		name string
+		n    *Node
+	}{
+		{name: "token", n: MustToken("a")},
+		{name: "graphic token", n: MustToken("=:")},
+		{name: "hex", n: MustHexadecimal([]byte{1})},
+		{name: "hinted hex", n: &Node{Kind: KindHexadecimal, OctetString: []byte{1}, Hint: LengthHint{Has: true, Length: 1}}},
+		{name: "base64", n: MustBase64([]byte("a"))},
+		{name: "hinted base64", n: &Node{Kind: KindBase64, OctetString: []byte("a"), Hint: LengthHint{Has: true, Length: 1}}},
+		{name: "empty hex", n: MustHexadecimal(nil)},
+		{name: "list", n: MustList(MustToken("b"))},
+		{name: "empty list", n: MustList()},
+	}
+
+	p := LimitedParser.WithPreserveHints(true)
+	for _, a := range samples {
+		for _, b := range samples {
+			t.Run(a.name+"/"+b.name, func(t *testing.T) {
+				n := MustList(a.n, b.n, a.n)
+
+				s := n.String()
+				got, err := p.ParseNode(strings.NewReader(s))
+				if err != nil || !got.Equal(n) {
+					t.Errorf("ParseNode(%q) = %v, %v, want %v", s, got, err, n)
+				}
+
+				m := n.Minify()
+				got, err = p.ParseNode(strings.NewReader(m))
+				if err != nil || !got.EqualSemantic(n) {
+					t.Errorf("ParseNode(%q) = %v, %v, want %v", m, got, err, n)
+				}
+			})
+		}
+	}
+}
+
+func TestParser_ParseDecimal(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    uint64
+		wantErr error
+	}{
+		{s: "0#", want: 0},
+		{s: "007|", want: 7},
+		{s: "123#", want: 123},
+		{s: "18446744073709551615#", want: math.MaxUint64},
+		{s: "18446744073709551616#", wantErr: ErrInvalidLengthPrefix},
+		{s: "99999999999999999999999#", wantErr: ErrInvalidLengthPrefix},
+		{s: "#", wantErr: ErrInvalidLengthPrefix},
+		{s: "12", wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			s := strings.NewReader(tt.s)
+			got, err := LimitedParser.ParseDecimal(s)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseDecimal() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseDecimal() = %v, want %v", got, tt.want)
+			}
+			// the terminating char is left unread:
+			if r, _, _ := s.ReadRune(); r != rune(tt.s[len(tt.s)-1]) {
+				t.Errorf("ParseDecimal() consumed %q", r)
+			}
+		})
+	}
+
+	if _, err := Parse(strings.NewReader("18446744073709551616#61#")); !errors.Is(err, ErrInvalidLengthPrefix) {
+		t.Errorf("Parse() error = %v, want %v", err, ErrInvalidLengthPrefix)
+	}
+}
+
+func BenchmarkParseDecimal(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteRune('(')
+	for i := 0; i < 1000; i++ {
+		sb.WriteString(" 3#616263# 2|YWI=|")
+	}
+	sb.WriteRune(')')
+	input := sb.String()
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = Parse(strings.NewReader(input))
+	}
+}
+
+func TestNode_Reader_AtomChunks(t *testing.T) {
+	for size := 0; size < 3*atomChunk; size++ {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		for _, n := range []*Node{MustHexadecimal(data), MustBase64(data), RawUnchecked(bytes.Repeat([]byte("a"), size+1))} {
+			b, err := io.ReadAll(n.Reader())
+			if err != nil || string(b) != n.String() {
+				t.Fatalf("Reader() of %d octets = %q, %v, want %q", size, b, err, n.String())
+			}
+		}
+	}
+}
+
+func TestParse_MaxTotalOctets_StopsReading(t *testing.T) {
+	// the budget is enforced while the body is read, not after it is buffered:
+	for _, input := range []string{
+		"#" + strings.Repeat("61", 1<<20) + "#",
+		"|" + strings.Repeat("YWJj", 1<<18) + "|",
+		"(#6162# |" + strings.Repeat("YWJj", 1<<18) + "|)",
+	} {
+		s := strings.NewReader(input)
+		_, err := LimitedParser.WithMaxTotalOctets(4).ParseNode(s)
+		if !errors.Is(err, ErrInputTooLarge) {
+			t.Fatalf("ParseNode() error = %v, want %v", err, ErrInputTooLarge)
+		}
+		if read := len(input) - s.Len(); read > 32 {
+			t.Errorf("ParseNode() read %d bytes, want at most 32", read)
+		}
+	}
+}